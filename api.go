@@ -0,0 +1,88 @@
+package pimbin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/go-chi/chi"
+)
+
+// language describes one of the languages that files can be highlighted
+// as.
+type language struct {
+	Name      string   `json:"name"`
+	Aliases   []string `json:"aliases"`
+	Filenames []string `json:"filenames"`
+	MimeTypes []string `json:"mime_types"`
+}
+
+func (s *Server) handleLanguages(w http.ResponseWriter, r *http.Request) {
+	langs := make([]language, 0, len(lexers.Registry.Lexers))
+	for _, l := range lexers.Registry.Lexers {
+		cfg := l.Config()
+		langs = append(langs, language{
+			Name:      cfg.Name,
+			Aliases:   nonNil(cfg.Aliases),
+			Filenames: nonNil(cfg.Filenames),
+			MimeTypes: nonNil(cfg.MimeTypes),
+		})
+	}
+	writeJSON(w, langs)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		RenderCache cacheStats `json:"render_cache"`
+	}{s.renderCache.Stats()})
+}
+
+// handleListPastes lists the pastes of the user making the request.
+func (s *Server) handleListPastes(w http.ResponseWriter, r *http.Request) {
+	u, ok := r.Context().Value(userKey).(*User)
+	if !ok {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	pastes, err := s.db.Pastes(u.Name, strings.ToLower(r.URL.Query().Get("tag")))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for i := range pastes {
+		if pastes[i].Files == nil {
+			pastes[i].Files = []File{}
+		}
+	}
+	writeJSON(w, pastes)
+}
+
+func (s *Server) handleGetPasteJSON(w http.ResponseWriter, r *http.Request) {
+	p, err := s.db.Paste(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if p.Files == nil {
+		p.Files = []File{}
+	}
+	writeJSON(w, p)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// nonNil makes sure a slice is encoded as an empty array instead of null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
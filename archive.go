@@ -0,0 +1,160 @@
+package pimbin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+func (s *Server) handleGetArchive(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	p, err := s.db.Paste(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var write func(io.Writer, []archiveFile) error
+	var ctype, ext string
+	switch chi.URLParam(r, "format") {
+	case "zip":
+		write, ctype, ext = writeZip, "application/zip", ".zip"
+	case "tar.gz":
+		write, ctype, ext = writeTarGz, "application/gzip", ".tar.gz"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	// A short link has no files to put in an archive.
+	if len(p.Files) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	// Every blob is looked at before the headers are sent, so that a
+	// missing one is an error instead of an archive without it.
+	files, err := s.statArchiveFiles(p.Files)
+	if os.IsNotExist(err) {
+		http.Error(w, "The paste's files are missing", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s%s"`, p.ID, ext))
+	// Headers are already sent by the time anything else can go wrong, so
+	// the client will be left with a truncated archive.
+	if err := write(w, files); err != nil {
+		log.Printf("archive %s: %v", p.ID, err)
+	}
+}
+
+// archiveFile is a blob to put in an archive under a name. It's only
+// opened while it's being copied, so that big pastes don't hold a file
+// descriptor for each of their files.
+type archiveFile struct {
+	path string
+	name string
+	info os.FileInfo
+}
+
+func (s *Server) statArchiveFiles(files []File) ([]archiveFile, error) {
+	var found []archiveFile
+	for i, name := range archiveNames(files) {
+		file := filepath.Join(s.Config.UploadsDir, files[i].Hash)
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, archiveFile{path: file, name: name, info: info})
+	}
+	return found, nil
+}
+
+// copyTo writes the blob's contents to w.
+func (f archiveFile) copyTo(w io.Writer) error {
+	r, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func writeZip(w io.Writer, files []archiveFile) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		hdr, err := zip.FileInfoHeader(f.info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = f.name
+		hdr.Method = zip.Deflate
+		entry, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := f.copyTo(entry); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, files []archiveFile) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.name,
+			Size:     f.info.Size(),
+			Mode:     0644,
+			ModTime:  f.info.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := f.copyTo(tw); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// archiveNames returns a name for each of the files to use inside an
+// archive. Empty names are replaced with the file's hash, and
+// duplicates get a numeric suffix before their extension.
+func archiveNames(files []File) []string {
+	names := make([]string, len(files))
+	seen := make(map[string]bool)
+	for i, f := range files {
+		name := strings.TrimLeft(path.Clean("/"+f.Name), "/")
+		if name == "" {
+			name = f.Hash
+		}
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 1; seen[name]; n++ {
+			name = base + "-" + strconv.Itoa(n) + ext
+		}
+		seen[name] = true
+		names[i] = name
+	}
+	return names
+}
@@ -0,0 +1,129 @@
+package pimbin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArchiveNames(t *testing.T) {
+	files := []File{
+		{Name: "a.txt"},
+		{Name: "a.txt"},
+		{Name: "dir/a.txt"},
+		{Name: "../../a.txt"},
+		{Name: "", Hash: "somehash"},
+		{Name: "Makefile"},
+		{Name: "Makefile"},
+	}
+	want := []string{"a.txt", "a-1.txt", "dir/a.txt", "a-2.txt", "somehash", "Makefile", "Makefile-1"}
+	if got := archiveNames(files); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// readArchive returns the names and contents of the files in a zip or
+// gzipped tar archive.
+func readArchive(t *testing.T, format string, b []byte) map[string]string {
+	files := make(map[string]string)
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = string(body)
+		}
+	case "tar.gz":
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[hdr.Name] = string(body)
+		}
+	}
+	return files
+}
+
+func TestGetArchive(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	p := Paste{ID: "paste"}
+	for _, f := range []archiveEntry{{"a.txt", "first\n"}, {"dir/b.txt", "second\n"}, {"a.txt", "third\n"}} {
+		hash, err := s.downloadFile(strings.NewReader(f.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Files = append(p.Files, File{Hash: hash, Name: f.name})
+	}
+	if err := s.db.PutPaste(p); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a.txt": "first\n", "dir/b.txt": "second\n", "a-1.txt": "third\n"}
+
+	for _, format := range []string{"zip", "tar.gz"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/paste/archive."+format, nil))
+		if w.Code != 200 {
+			t.Errorf("%s: got status %d", format, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="paste.`+format+`"` {
+			t.Errorf("%s: got Content-Disposition %q", format, got)
+		}
+		if got := readArchive(t, format, w.Body.Bytes()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got files %q, want %q", format, got, want)
+		}
+	}
+
+	if err := s.db.PutPaste(Paste{ID: "link", URL: "https://example.com/"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/paste/archive.rar", "/nothing/archive.zip", "/link/archive.zip", "/link/archive.tar.gz"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 404 {
+			t.Errorf("%s: got status %d, want 404", path, w.Code)
+		}
+	}
+
+	// A missing blob fails the whole archive before anything is sent.
+	err := s.db.PutPaste(Paste{ID: "broken", Files: []File{p.Files[0], {Hash: "missing", Name: "b.txt"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/broken/archive.zip", nil))
+	if w.Code != 404 || w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("archive with a missing file: got status %d and headers %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,203 @@
+package pimbin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// renderCache is a cache of rendered files, bounded by the total size
+// of the HTML in it. Entries are kept in memory and, if dir is set, on
+// disk, where they outlive the ones evicted from memory.
+type renderCache struct {
+	hits     uint64
+	diskHits uint64
+	misses   uint64
+
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	dir      string
+	diskMu   sync.Mutex
+	maxDisk  int64
+	diskSize int64
+}
+
+type cacheEntry struct {
+	key   string
+	value string
+}
+
+// cacheStats are the counters of a renderCache.
+type cacheStats struct {
+	Hits     uint64 `json:"hits"`
+	DiskHits uint64 `json:"disk_hits"`
+	Misses   uint64 `json:"misses"`
+	Entries  int    `json:"entries"`
+	Size     int64  `json:"size"`
+	DiskSize int64  `json:"disk_size"`
+}
+
+// newRenderCache returns a cache holding up to maxSize bytes in memory,
+// and if dir isn't empty, up to maxDisk bytes in dir.
+func newRenderCache(maxSize int64, dir string, maxDisk int64) (*renderCache, error) {
+	c := &renderCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		dir:     dir,
+		maxDisk: maxDisk,
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			c.diskSize += info.Size()
+		}
+	}
+	return c, nil
+}
+
+// Get returns the cached value for key, if there is one.
+func (c *renderCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return e.Value.(*cacheEntry).value, true
+	}
+	c.mu.Unlock()
+	if c.dir != "" {
+		path := c.path(key)
+		if b, err := ioutil.ReadFile(path); err == nil {
+			// The modification time is what disk eviction goes by.
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			atomic.AddUint64(&c.diskHits, 1)
+			c.putMemory(key, string(b))
+			return string(b), true
+		}
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return "", false
+}
+
+// Put adds a value to the cache.
+func (c *renderCache) Put(key, value string) {
+	c.putMemory(key, value)
+	if c.dir != "" {
+		c.putDisk(key, value)
+	}
+}
+
+func (c *renderCache) putMemory(key, value string) {
+	size := int64(len(key) + len(value))
+	if size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: value})
+	c.size += size
+	for c.size > c.maxSize {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.key) + len(entry.value))
+	}
+}
+
+func (c *renderCache) putDisk(key, value string) {
+	if int64(len(value)) > c.maxDisk {
+		return
+	}
+	tmp, err := ioutil.TempFile(c.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.WriteString(value)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	c.diskMu.Lock()
+	defer c.diskMu.Unlock()
+	c.diskSize += int64(len(value))
+	if c.diskSize > c.maxDisk {
+		c.evictDisk()
+	}
+}
+
+// evictDisk removes the least recently used files on disk until they
+// take up no more than three quarters of the limit, so that it doesn't
+// have to happen again on the next Put.
+func (c *renderCache) evictDisk() {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	c.diskSize = 0
+	for _, info := range infos {
+		c.diskSize += info.Size()
+	}
+	for _, info := range infos {
+		if c.diskSize <= c.maxDisk/4*3 {
+			break
+		}
+		if os.Remove(filepath.Join(c.dir, info.Name())) == nil {
+			c.diskSize -= info.Size()
+		}
+	}
+}
+
+func (c *renderCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Stats returns the cache's counters.
+func (c *renderCache) Stats() cacheStats {
+	c.mu.Lock()
+	entries, size := len(c.entries), c.size
+	c.mu.Unlock()
+	c.diskMu.Lock()
+	diskSize := c.diskSize
+	c.diskMu.Unlock()
+	return cacheStats{
+		Hits:     atomic.LoadUint64(&c.hits),
+		DiskHits: atomic.LoadUint64(&c.diskHits),
+		Misses:   atomic.LoadUint64(&c.misses),
+		Entries:  entries,
+		Size:     size,
+		DiskSize: diskSize,
+	}
+}
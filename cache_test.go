@@ -0,0 +1,175 @@
+package pimbin
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cachedKeys returns which of keys are in the cache's memory tier,
+// without touching their place in it.
+func cachedKeys(c *renderCache, keys ...string) string {
+	var found []string
+	for _, key := range keys {
+		if _, ok := c.entries[key]; ok {
+			found = append(found, key)
+		}
+	}
+	return strings.Join(found, ",")
+}
+
+func TestRenderCacheMemory(t *testing.T) {
+	// Each entry is a one byte key and a nine byte value, so three fit.
+	c, err := newRenderCache(30, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("x", 9)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Put(key, value)
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a isn't cached")
+	}
+	c.Put("d", value)
+	if got := cachedKeys(c, "a", "b", "c", "d"); got != "a,c,d" {
+		t.Errorf("after adding d: got %s, want the least recently used b evicted", got)
+	}
+	// Putting a key that's already there moves it to the front, but
+	// doesn't count it twice.
+	c.Put("c", value)
+	if stats := c.Stats(); stats.Entries != 3 || stats.Size != 30 {
+		t.Errorf("got %d entries of %d bytes, want 3 of 30", stats.Entries, stats.Size)
+	}
+
+	// A value bigger than the whole cache isn't kept, and doesn't push
+	// anything else out either.
+	c.Put("e", strings.Repeat("x", 30))
+	if got := cachedKeys(c, "a", "c", "d", "e"); got != "a,c,d" {
+		t.Errorf("after adding a big value: got %s", got)
+	}
+	// One that fits makes room for itself.
+	c.Put("f", strings.Repeat("x", 19))
+	if got := cachedKeys(c, "a", "c", "d", "f"); got != "c,f" {
+		t.Errorf("after adding a bigger value: got %s, want c,f", got)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("got an evicted value")
+	}
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Size != 30 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestRenderCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pimbin-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := newRenderCache(20, dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put("a", "first value")
+	c.Put("b", "second value")
+	if got := cachedKeys(c, "a", "b"); got != "b" {
+		t.Fatalf("got %s in memory, want b", got)
+	}
+
+	// a was evicted from memory, but it's still on disk, and reading it
+	// from there puts it back in memory.
+	if value, ok := c.Get("a"); !ok || value != "first value" {
+		t.Fatalf("got %q, %t", value, ok)
+	}
+	if got := cachedKeys(c, "a", "b"); got != "a" {
+		t.Errorf("after reading a from disk: got %s in memory, want a", got)
+	}
+	if err := os.Remove(c.path("a")); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := c.Get("a"); !ok || value != "first value" {
+		t.Errorf("after removing a from disk: got %q, %t", value, ok)
+	}
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.DiskHits != 1 || stats.Misses != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	// Reopening the cache counts what's already on disk.
+	c, err = newRenderCache(20, dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.DiskSize != int64(len("second value")) || stats.Entries != 0 {
+		t.Errorf("after reopening: got stats %+v", stats)
+	}
+	if value, ok := c.Get("b"); !ok || value != "second value" {
+		t.Errorf("after reopening: got %q, %t", value, ok)
+	}
+}
+
+func TestRenderCacheEvictDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pimbin-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := newRenderCache(0, dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ten values of ten bytes fill the disk exactly, with the first
+	// being the least recently used.
+	old := time.Now().Add(-time.Hour)
+	value := strings.Repeat("x", 10)
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		c.Put(key, value)
+		mtime := old.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(c.path(key), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := c.Stats(); stats.DiskSize != 100 {
+		t.Fatalf("got %d bytes on disk, want 100", stats.DiskSize)
+	}
+	// Reading a value off the disk makes it the most recently used.
+	if _, ok := c.Get("0"); !ok {
+		t.Fatal("0 isn't cached")
+	}
+
+	// Going over the limit trims the disk down to three quarters of it,
+	// starting with the least recently used.
+	c.Put("10", value)
+	if stats := c.Stats(); stats.DiskSize != 70 {
+		t.Errorf("got %d bytes on disk, want 70", stats.DiskSize)
+	}
+	var kept []string
+	for i := 0; i <= 10; i++ {
+		key := strconv.Itoa(i)
+		if _, err := os.Stat(c.path(key)); err == nil {
+			kept = append(kept, key)
+		}
+	}
+	if got := strings.Join(kept, ","); got != "0,5,6,7,8,9,10" {
+		t.Errorf("got %s on disk, want 0,5,6,7,8,9,10", got)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(kept) {
+		t.Errorf("got %d files on disk, want %d", len(infos), len(kept))
+	}
+
+	// A value bigger than the limit isn't written at all.
+	c.Put("big", strings.Repeat("x", 101))
+	if _, err := os.Stat(c.path("big")); !os.IsNotExist(err) {
+		t.Errorf("a value over the limit was written: %v", err)
+	}
+}
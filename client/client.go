@@ -0,0 +1,399 @@
+// Package client is a client for the API of a pimbin server.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erebid/pimbin/paste"
+)
+
+// Errors that a StatusError can wrap, for the statuses that the server
+// uses for them.
+var (
+	ErrBadRequest     = errors.New("bad request")
+	ErrUnauthorized   = errors.New("unauthorized")
+	ErrForbidden      = errors.New("forbidden")
+	ErrNotFound       = errors.New("not found")
+	ErrTooLarge       = errors.New("upload too large")
+	ErrTypeNotAllowed = errors.New("content type not allowed")
+	ErrNotImplemented = errors.New("not supported by the server")
+	ErrServer         = errors.New("server error")
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusTeapot:                ErrTypeNotAllowed,
+	http.StatusNotImplemented:        ErrNotImplemented,
+}
+
+// StatusError is an error response from the server. It wraps one of the
+// errors above, so they can be checked for with errors.Is.
+type StatusError struct {
+	StatusCode int
+	// Message is the body of the response.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s", http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *StatusError) Unwrap() error {
+	if err, ok := statusErrors[e.StatusCode]; ok {
+		return err
+	}
+	if e.StatusCode >= 500 {
+		return ErrServer
+	}
+	return nil
+}
+
+// Client talks to a pimbin server.
+type Client struct {
+	// URL is the server's base URL.
+	URL string
+	// Token authenticates requests that need a user.
+	Token string
+	// KeepMetadata keeps the metadata of uploaded images, if the server
+	// is set to remove it.
+	KeepMetadata bool
+	// HTTPClient is used to make requests. If it's nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL, token string) *Client {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &Client{URL: baseURL, Token: token}
+}
+
+// File is a file to upload.
+type File struct {
+	// Name is the file's name in the paste. If it's empty, the server
+	// makes one up.
+	Name string
+	// Lang is the language to highlight the file as.
+	Lang string
+	// Extract unpacks the file, if it's an archive, into the files in it.
+	Extract bool
+	// Body is the file's contents. It's read as the upload is sent, and
+	// closed afterwards if it's an io.Closer.
+	Body io.Reader
+}
+
+// Info is what's said about a paste, besides its files.
+type Info struct {
+	Title       string
+	Description string
+	Tags        []string
+}
+
+// Upload makes a paste of files, returning its URL. The files are
+// streamed to the server as they're read.
+func (c *Client) Upload(ctx context.Context, files ...File) (string, error) {
+	return c.UploadWithInfo(ctx, Info{}, files...)
+}
+
+// UploadWithInfo is like Upload, but also gives the paste a title,
+// description and tags.
+func (c *Client) UploadWithInfo(ctx context.Context, info Info, files ...File) (string, error) {
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(c.writeForm(form, info, files))
+	}()
+	resp, err := c.do(ctx, "POST", "", pr, form.FormDataContentType())
+	pr.Close()
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return strings.TrimSpace(string(b)), err
+}
+
+func (c *Client) writeForm(form *multipart.Writer, info Info, files []File) error {
+	defer func() {
+		for _, f := range files {
+			if closer, ok := f.Body.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}()
+	// This has to come before the files.
+	if c.KeepMetadata {
+		if err := form.WriteField("keep-metadata", "true"); err != nil {
+			return err
+		}
+	}
+	if err := writeInfo(form.WriteField, info); err != nil {
+		return err
+	}
+	for i, f := range files {
+		n := strconv.Itoa(i + 1)
+		if f.Lang != "" {
+			if err := form.WriteField("lang:"+n, f.Lang); err != nil {
+				return err
+			}
+		}
+		if f.Extract {
+			if err := form.WriteField("extract:"+n, "true"); err != nil {
+				return err
+			}
+		}
+		w, err := form.CreateFormFile("file:"+n, f.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, f.Body); err != nil {
+			return err
+		}
+	}
+	return form.Close()
+}
+
+func writeInfo(write func(k, v string) error, info Info) error {
+	if info.Title != "" {
+		if err := write("title", info.Title); err != nil {
+			return err
+		}
+	}
+	if info.Description != "" {
+		if err := write("description", info.Description); err != nil {
+			return err
+		}
+	}
+	for _, t := range info.Tags {
+		if err := write("tag", t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes are changes to a paste's title, description or tags. Anything
+// left nil stays as it is.
+type Changes struct {
+	Title       *string
+	Description *string
+	Tags        *[]string
+}
+
+// Edit changes the title, description or tags of the paste with the
+// given ID, returning the paste as it is afterwards.
+func (c *Client) Edit(ctx context.Context, id string, changes Changes) (*paste.Paste, error) {
+	form := url.Values{}
+	if changes.Title != nil {
+		form.Set("title", *changes.Title)
+	}
+	if changes.Description != nil {
+		form.Set("description", *changes.Description)
+	}
+	if changes.Tags != nil {
+		// An empty tag is ignored, but clears the tags if there are none.
+		form["tag"] = append([]string{""}, *changes.Tags...)
+	}
+	resp, err := c.do(ctx, "PATCH", url.PathEscape(id),
+		strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var p paste.Paste
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Shorten makes a short link to link, returning its URL.
+func (c *Client) Shorten(ctx context.Context, link string) (string, error) {
+	var b strings.Builder
+	form := multipart.NewWriter(&b)
+	form.WriteField("url", link)
+	form.Close()
+	resp, err := c.do(ctx, "POST", "", strings.NewReader(b.String()),
+		form.FormDataContentType())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return strings.TrimSpace(string(body)), err
+}
+
+// Get returns the paste with the given ID.
+func (c *Client) Get(ctx context.Context, id string) (*paste.Paste, error) {
+	resp, err := c.do(ctx, "GET", "api/v1/pastes/"+url.PathEscape(id), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var p paste.Paste
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Open returns the contents of one of a paste's files. It has to be
+// closed when done.
+func (c *Client) Open(ctx context.Context, f paste.File) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "GET", "raw/"+f.Hash, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete deletes the paste with the given ID.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, "DELETE", url.PathEscape(id), nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the pastes of the client's user, newest first.
+func (c *Client) List(ctx context.Context) ([]paste.Paste, error) {
+	return c.list(ctx, "api/v1/pastes")
+}
+
+// ListTagged is like List, but only returns the pastes with a tag.
+func (c *Client) ListTagged(ctx context.Context, tag string) ([]paste.Paste, error) {
+	return c.list(ctx, "api/v1/pastes?tag="+url.QueryEscape(tag))
+}
+
+func (c *Client) list(ctx context.Context, path string) ([]paste.Paste, error) {
+	resp, err := c.do(ctx, "GET", path, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var pastes []paste.Paste
+	if err := json.NewDecoder(resp.Body).Decode(&pastes); err != nil {
+		return nil, err
+	}
+	return pastes, nil
+}
+
+// SearchQuery is a search for files in the user's pastes.
+type SearchQuery struct {
+	// Query is the words to look for in files' names and contents.
+	Query string
+	// Lang, Name and Owner, if they're set, limit the search to files
+	// of a language, with names containing Name, and for admins, of
+	// another user.
+	Lang  string
+	Name  string
+	Owner string
+	// Since and Until limit the search to pastes made in that range of
+	// days, if they're set.
+	Since time.Time
+	Until time.Time
+	// Limit is the largest number of results, or zero for the server's
+	// default.
+	Limit int
+}
+
+// SearchResult is a file found by a search.
+type SearchResult struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Lang    string    `json:"lang"`
+	Created time.Time `json:"created"`
+	// Snippet is HTML, with the words that matched in mark elements.
+	Snippet string `json:"snippet"`
+}
+
+// Search searches the files of the user's pastes, returning the best
+// matches first.
+func (c *Client) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	params := url.Values{}
+	for k, v := range map[string]string{
+		"q":     q.Query,
+		"lang":  q.Lang,
+		"name":  q.Name,
+		"owner": q.Owner,
+	} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	if !q.Since.IsZero() {
+		params.Set("since", q.Since.Format("2006-01-02"))
+	}
+	if !q.Until.IsZero() {
+		params.Set("until", q.Until.Format("2006-01-02"))
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+	resp, err := c.do(ctx, "GET", "api/v1/search?"+params.Encode(), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var results []SearchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// do sends a request to the server, turning anything but a successful
+// response into a StatusError.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, ctype string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(msg)),
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,295 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/erebid/pimbin"
+	"github.com/erebid/pimbin/config"
+	"github.com/erebid/pimbin/paste"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		code int
+		want error
+	}{
+		{400, ErrBadRequest},
+		{401, ErrUnauthorized},
+		{403, ErrForbidden},
+		{404, ErrNotFound},
+		{413, ErrTooLarge},
+		{418, ErrTypeNotAllowed},
+		{501, ErrNotImplemented},
+		{500, ErrServer},
+		{503, ErrServer},
+		{409, nil},
+		{302, nil},
+	}
+	for _, tt := range tests {
+		var err error = &StatusError{StatusCode: tt.code}
+		if got := errors.Unwrap(err); got != tt.want {
+			t.Errorf("status %d wraps %v, want %v", tt.code, got, tt.want)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("status %d isn't %v", tt.code, tt.want)
+		}
+	}
+
+	err := &StatusError{StatusCode: 404, Message: "no such paste"}
+	if got := err.Error(); got != "Not Found: no such paste" {
+		t.Errorf("got message %q", got)
+	}
+	err.Message = ""
+	if got := err.Error(); got != "Not Found" {
+		t.Errorf("without a message: got %q", got)
+	}
+}
+
+// newTestServer starts a pimbin server with a user for each of names,
+// and returns it with the users' tokens and a function that stops it.
+func newTestServer(t *testing.T, names ...string) (*httptest.Server, map[string]string, func()) {
+	dir, err := ioutil.TempDir("", "pimbin-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Defaults()
+	cfg.UploadsDir = filepath.Join(dir, "uploads")
+	cfg.DBPath = filepath.Join(dir, "pimbin.db")
+	cfg.MaxBodySize = 1 << 20
+	db, err := pimbin.OpenSQLiteDB(cfg.DBPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	tokens := make(map[string]string)
+	for _, name := range names {
+		// Nobody logs in as them, so any password hash will do.
+		u := pimbin.User{Name: name, Password: "x"}
+		if err := db.CreateUser(&u); err != nil {
+			t.Fatal(err)
+		}
+		if tokens[name], err = db.RefreshToken(&u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The server has to know its own URL, which isn't known until it's
+	// listening.
+	var s *pimbin.Server
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(w, r)
+	}))
+	cfg.BaseURL = ts.URL + "/"
+	if s, err = pimbin.NewServer(*cfg, db); err != nil {
+		ts.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return ts, tokens, func() {
+		ts.Close()
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// closeRecorder is a file's body that remembers being closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// failingReader fails after the data in it has been read.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.data == "" {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestUpload(t *testing.T) {
+	ts, tokens, cleanup := newTestServer(t, "alice")
+	defer cleanup()
+	ctx := context.Background()
+	c := New(ts.URL, tokens["alice"])
+
+	// Bigger than any buffer along the way, so it has to be streamed.
+	big := strings.Repeat("0123456789abcdef", 1<<14)
+	body := &closeRecorder{Reader: strings.NewReader("package main\n")}
+	link, err := c.UploadWithInfo(ctx,
+		Info{Title: "Title", Description: "About it", Tags: []string{"b", "A"}},
+		File{Name: "main.go", Body: body},
+		File{Name: "big.txt", Lang: "Python", Body: strings.NewReader(big)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !body.closed {
+		t.Error("the file's body wasn't closed")
+	}
+	if !strings.HasPrefix(link, c.URL) {
+		t.Fatalf("got URL %q", link)
+	}
+	p, err := c.Get(ctx, strings.TrimPrefix(link, c.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "Title" || p.Description != "About it" || !reflect.DeepEqual(p.Tags, []string{"a", "b"}) {
+		t.Errorf("got title %q, description %q and tags %q", p.Title, p.Description, p.Tags)
+	}
+	if len(p.Files) != 2 || p.Files[0].Name != "main.go" || p.Files[1].Name != "big.txt" || p.Files[1].Lang != "Python" {
+		t.Fatalf("got files %+v", p.Files)
+	}
+	r, err := c.Open(ctx, p.Files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != big {
+		t.Errorf("got %d bytes back, error %v", len(b), err)
+	}
+
+	// A failure reading a file stops the upload.
+	errRead := errors.New("read failed")
+	_, err = c.Upload(ctx, File{Name: "a.txt", Body: &failingReader{data: "hello\n", err: errRead}})
+	if !errors.Is(err, errRead) {
+		t.Errorf("uploading a file that can't be read: got error %v", err)
+	}
+
+	for _, tt := range []struct {
+		desc  string
+		token string
+		file  File
+		want  error
+	}{
+		{"without a token", "", File{Name: "a.txt", Body: strings.NewReader("hello\n")}, ErrUnauthorized},
+		{"with a bad token", "nope", File{Name: "a.txt", Body: strings.NewReader("hello\n")}, ErrForbidden},
+		{"unknown language", tokens["alice"], File{Name: "a.txt", Lang: "nonsense", Body: strings.NewReader("hello\n")}, ErrBadRequest},
+		{"too large", tokens["alice"], File{Name: "a.txt", Body: strings.NewReader(big + big + big + big + big)}, ErrTooLarge},
+	} {
+		c := New(ts.URL, tt.token)
+		_, err := c.Upload(ctx, tt.file)
+		var statusErr *StatusError
+		if !errors.Is(err, tt.want) || !errors.As(err, &statusErr) {
+			t.Errorf("%s: got error %v, want %v", tt.desc, err, tt.want)
+		}
+	}
+}
+
+func TestEdit(t *testing.T) {
+	ts, tokens, cleanup := newTestServer(t, "alice", "bob")
+	defer cleanup()
+	ctx := context.Background()
+	c := New(ts.URL, tokens["alice"])
+	link, err := c.UploadWithInfo(ctx, Info{Title: "Title", Tags: []string{"a"}},
+		File{Name: "a.txt", Body: strings.NewReader("hello\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimPrefix(link, c.URL)
+
+	description := "About it"
+	p, err := c.Edit(ctx, id, Changes{Description: &description})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "Title" || p.Description != description || !reflect.DeepEqual(p.Tags, []string{"a"}) {
+		t.Errorf("after changing the description: got %+v", *p)
+	}
+	title, tags := "", []string{"C", "b"}
+	p, err = c.Edit(ctx, id, Changes{Title: &title, Tags: &tags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "" || p.Description != description || !reflect.DeepEqual(p.Tags, []string{"b", "c"}) {
+		t.Errorf("after changing the title and tags: got %+v", *p)
+	}
+	tags = nil
+	if p, err = c.Edit(ctx, id, Changes{Tags: &tags}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Tags) != 0 || len(p.Files) != 1 {
+		t.Errorf("after clearing the tags: got %+v", *p)
+	}
+	if p, err = c.Get(ctx, id); err != nil || len(p.Tags) != 0 || p.Description != description {
+		t.Errorf("got %+v, error %v", p, err)
+	}
+
+	if _, err := New(ts.URL, tokens["bob"]).Edit(ctx, id, Changes{Title: &title}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("editing someone else's paste: got error %v", err)
+	}
+	if _, err := c.Edit(ctx, "missing", Changes{Title: &title}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("editing a missing paste: got error %v", err)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting a missing paste: got error %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	ts, tokens, cleanup := newTestServer(t, "alice", "bob")
+	defer cleanup()
+	ctx := context.Background()
+	alice, bob := New(ts.URL, tokens["alice"]), New(ts.URL, tokens["bob"])
+	var ids []string
+	for _, tt := range []struct {
+		c    *Client
+		tags []string
+	}{
+		{alice, []string{"x"}},
+		{bob, []string{"x"}},
+		{alice, nil},
+		{alice, []string{"x", "y"}},
+	} {
+		link, err := tt.c.UploadWithInfo(ctx, Info{Tags: tt.tags},
+			File{Name: "a.txt", Body: strings.NewReader("hello\n")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, strings.TrimPrefix(link, tt.c.URL))
+	}
+
+	idsOf := func(pastes []paste.Paste, err error) []string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, p := range pastes {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+	if got, want := idsOf(alice.List(ctx)), []string{ids[3], ids[2], ids[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List: got %q, want %q", got, want)
+	}
+	if got, want := idsOf(alice.ListTagged(ctx, "X")), []string{ids[3], ids[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListTagged: got %q, want %q", got, want)
+	}
+	if got := idsOf(alice.ListTagged(ctx, "none")); len(got) != 0 {
+		t.Errorf("ListTagged with an unused tag: got %q", got)
+	}
+	if _, err := New(ts.URL, "").List(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("List without a token: got error %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erebid/pimbin/client"
+	"github.com/erebid/pimbin/config"
+	"github.com/erebid/pimbin/paste"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const clientUsage = `client commands, which talk to the server at PIMBIN_URL using the
+token in PIMBIN_TOKEN, or the url and token set in %s:
+
+	upload [options] [file...]          upload files, or stdin if none are given
+	delete <paste>...                   delete pastes
+	list   [-tag tag]                   list your pastes
+	edit   [options] <paste>            change a paste's title, description or tags
+	get    <paste> [file]               write a paste's file to stdout
+	open   <paste>                      open a paste in the browser
+	search [options] <words...>         search the files of your pastes
+`
+
+// clientCommands are the commands that are handled by runClient.
+var clientCommands = map[string]bool{
+	"upload": true,
+	"delete": true,
+	"list":   true,
+	"get":    true,
+	"open":   true,
+	"edit":   true,
+	"search": true,
+}
+
+// clientConfigPath returns where the client configuration is kept.
+func clientConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "pimbin", "client.toml")
+}
+
+func runClient(cmd string, args []string) {
+	cfg, err := config.LoadClient(clientConfigPath())
+	if err != nil {
+		fail("error loading client config: %s", err)
+	}
+	if cfg.URL == "" {
+		fail("no server URL: set PIMBIN_URL or url in %s", clientConfigPath())
+	}
+	c := client.New(cfg.URL, cfg.Token)
+	ctx := context.Background()
+	switch cmd {
+	case "upload":
+		err = upload(ctx, c, args)
+	case "delete":
+		err = deletePastes(ctx, c, args)
+	case "list":
+		err = list(ctx, c, args)
+	case "edit":
+		err = edit(ctx, c, args)
+	case "get":
+		err = get(ctx, c, args)
+	case "open":
+		err = open(c, args)
+	case "search":
+		err = search(ctx, c, args)
+	}
+	if err != nil {
+		fail("%s", err)
+	}
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+// pasteID returns the ID of a paste given either as its ID or its URL.
+func pasteID(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		return path.Base(u.Path)
+	}
+	return s
+}
+
+func upload(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	name := fs.String("name", "", "name of the file, if there's only one")
+	lang := fs.String("lang", "", "language to highlight the files as")
+	extract := fs.Bool("extract", false, "unpack archives into their files")
+	keep := fs.Bool("keep-metadata", false, "keep image metadata")
+	link := fs.String("url", "", "shorten a URL instead of uploading files")
+	title := fs.String("title", "", "title of the paste")
+	description := fs.String("description", "", "description of the paste")
+	tags := fs.String("tags", "", "comma separated tags for the paste")
+	fs.Parse(args)
+	paths := fs.Args()
+	if *name != "" && len(paths) > 1 {
+		return errors.New("-name can only be used with a single file")
+	}
+	if *link != "" {
+		u, err := c.Shorten(ctx, *link)
+		if err != nil {
+			return err
+		}
+		fmt.Println(u)
+		return nil
+	}
+
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	var files []client.File
+	for _, p := range paths {
+		f := client.File{
+			Name:    *name,
+			Lang:    *lang,
+			Extract: *extract,
+			Body:    os.Stdin,
+		}
+		if p != "-" {
+			file, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			f.Body = file
+			if f.Name == "" {
+				f.Name = filepath.Base(p)
+			}
+		}
+		files = append(files, f)
+	}
+	c.KeepMetadata = *keep
+	info := client.Info{
+		Title:       *title,
+		Description: *description,
+		Tags:        splitTags(*tags),
+	}
+	u, err := c.UploadWithInfo(ctx, info, files...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(u)
+	return nil
+}
+
+func deletePastes(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: pimbin delete <paste>...")
+	}
+	for _, arg := range args {
+		if err := c.Delete(ctx, pasteID(arg)); err != nil {
+			return fmt.Errorf("%s: %s", arg, err)
+		}
+	}
+	return nil
+}
+
+func list(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	tag := fs.String("tag", "", "only list pastes with this tag")
+	fs.Parse(args)
+	var pastes []paste.Paste
+	var err error
+	if *tag != "" {
+		pastes, err = c.ListTagged(ctx, *tag)
+	} else {
+		pastes, err = c.List(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range pastes {
+		var desc []string
+		if p.Title != "" {
+			desc = append(desc, strconv.Quote(p.Title))
+		}
+		if p.URL != "" {
+			desc = append(desc, p.URL, fmt.Sprintf("(%d clicks)", p.Clicks))
+		}
+		for _, f := range p.Files {
+			desc = append(desc, f.Name)
+		}
+		for _, t := range p.Tags {
+			desc = append(desc, "#"+t)
+		}
+		fmt.Printf("%s%s\t%s\n", c.URL, p.ID, strings.Join(desc, " "))
+	}
+	return nil
+}
+
+func edit(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	title := fs.String("title", "", "new title")
+	description := fs.String("description", "", "new description")
+	tags := fs.String("tags", "", "new comma separated tags, replacing the old ones")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: pimbin edit [options] <paste>")
+	}
+	// Only the flags that were given are changed, so that they can also
+	// be set to nothing.
+	var changes client.Changes
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "title":
+			changes.Title = title
+		case "description":
+			changes.Description = description
+		case "tags":
+			t := splitTags(*tags)
+			changes.Tags = &t
+		}
+	})
+	_, err := c.Edit(ctx, pasteID(fs.Arg(0)), changes)
+	return err
+}
+
+// splitTags splits a comma separated list of tags.
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+func get(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: pimbin get <paste> [file]")
+	}
+	p, err := c.Get(ctx, pasteID(args[0]))
+	if err != nil {
+		return err
+	}
+	if p.URL != "" {
+		fmt.Println(p.URL)
+		return nil
+	}
+	var file *paste.File
+	for i, f := range p.Files {
+		if len(args) == 2 && f.Name == args[1] || len(args) == 1 && len(p.Files) == 1 {
+			file = &p.Files[i]
+			break
+		}
+	}
+	if file == nil {
+		names := make([]string, len(p.Files))
+		for i, f := range p.Files {
+			names[i] = f.Name
+		}
+		return fmt.Errorf("pick one of the paste's files: %s",
+			strings.Join(names, ", "))
+	}
+	r, err := c.Open(ctx, *file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
+
+func open(c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: pimbin open <paste>")
+	}
+	u := c.URL + url.PathEscape(pasteID(args[0]))
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Run()
+}
+
+func search(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	lang := fs.String("lang", "", "only search files of this language")
+	name := fs.String("name", "", "only search files with names containing this")
+	owner := fs.String("owner", "", "search another user's pastes (admins only)")
+	since := fs.String("since", "", "only search pastes made on or after this date (YYYY-MM-DD)")
+	until := fs.String("until", "", "only search pastes made on or before this date (YYYY-MM-DD)")
+	limit := fs.Int("limit", 0, "largest number of results")
+	fs.Parse(args)
+	q := client.SearchQuery{
+		Query: strings.Join(fs.Args(), " "),
+		Lang:  *lang,
+		Name:  *name,
+		Owner: *owner,
+		Limit: *limit,
+	}
+	for _, d := range []struct {
+		s string
+		t *time.Time
+	}{{*since, &q.Since}, {*until, &q.Until}} {
+		if d.s == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", d.s)
+		if err != nil {
+			return fmt.Errorf("invalid date %q, use YYYY-MM-DD", d.s)
+		}
+		*d.t = t
+	}
+	results, err := c.Search(ctx, q)
+	if err != nil {
+		return err
+	}
+	// Matches are shown in bold, when there's a terminal to show it.
+	start, end := "", ""
+	if terminal.IsTerminal(int(os.Stdout.Fd())) {
+		start, end = "\x1b[1m", "\x1b[0m"
+	}
+	marks := strings.NewReplacer("<mark>", start, "</mark>", end)
+	for _, r := range results {
+		fmt.Printf("%s#%s\t%s\n", r.URL, r.Name, r.Created.Format("2006-01-02"))
+		snippet := html.UnescapeString(marks.Replace(r.Snippet))
+		for _, line := range strings.Split(strings.TrimSpace(snippet), "\n") {
+			fmt.Printf("\t%s\n", line)
+		}
+	}
+	return nil
+}
@@ -19,17 +19,25 @@ const usage = `usage: pimbin [-config path] <command> [options...]
 	create-user     <username> [hash]   create a user
 	change-password <username> [hash]   change a user's password
 	refresh-token   <username>          refresh a user's token
+	backfill                            store file sizes and types for old pastes
+	                                    and index any files missing from search
 	help                                show this message`
 
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		fmt.Fprintf(flag.CommandLine.Output(), "\n\n"+clientUsage,
+			clientConfigPath())
 	}
 }
 func main() {
 	var configPath string
 	flag.StringVar(&configPath, "config", "", "path to configuration file")
 	flag.Parse()
+	if cmd := flag.Arg(0); clientCommands[cmd] {
+		runClient(cmd, flag.Args()[1:])
+		return
+	}
 
 	var cfg *config.Server
 	if configPath != "" {
@@ -133,12 +141,18 @@ func main() {
 			os.Exit(1)
 		}
 		fmt.Printf("%s's token: %s\n", name, token)
+	case "backfill":
+		described, indexed, err := pimbin.Backfill(*cfg, db)
+		if err != nil {
+			fmt.Printf("error backfilling metadata: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("updated %d files, indexed %d files\n", described, indexed)
 	case "run":
-		s, err := pimbin.NewServer(db)
+		s, err := pimbin.NewServer(*cfg, db)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		s.Config = *cfg
 		log.Fatalln(http.ListenAndServe(cfg.Addr, s))
 	default:
 		flag.Usage()
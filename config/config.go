@@ -3,6 +3,7 @@ package config
 import (
 	"io"
 	"os"
+	"strings"
 
 	toml "github.com/pelletier/go-toml"
 )
@@ -16,8 +17,35 @@ type Server struct {
 	Filter      []string `toml:"filter-types"`
 	MaxBodySize int64    `toml:"max-body-size"`
 	CSSPath     string   `toml:"css"`
+	Style       string   `toml:"style"`
+	DarkStyle   string   `toml:"dark-style"`
+	Templates   string   `toml:"templates"`
+	Dev         bool     `toml:"dev"`
 	SiteName    string   `toml:"name"`
 	NoAuth      bool     `toml:"no-auth"`
+	SiteURL     string   `toml:"site-url"`
+	CountClicks bool     `toml:"count-clicks"`
+
+	RenderCacheSize     int64  `toml:"render-cache-size"`
+	RenderCacheDir      string `toml:"render-cache-dir"`
+	RenderCacheDiskSize int64  `toml:"render-cache-disk-size"`
+
+	ThumbnailSize int  `toml:"thumbnail-size"`
+	StripMetadata bool `toml:"strip-metadata"`
+
+	ExtractMaxEntries int   `toml:"extract-max-entries"`
+	ExtractMaxSize    int64 `toml:"extract-max-size"`
+	ExtractMaxDepth   int   `toml:"extract-max-depth"`
+
+	FetchTimeout      int      `toml:"fetch-timeout"`
+	FetchMaxRedirects int      `toml:"fetch-max-redirects"`
+	FetchAllow        []string `toml:"fetch-allow"`
+
+	Admins        []string `toml:"admins"`
+	SearchMaxSize int64    `toml:"search-max-size"`
+
+	TusMaxSize int64 `toml:"tus-max-size"`
+	TusExpiry  int   `toml:"tus-expiry"`
 }
 
 func Defaults() *Server {
@@ -28,6 +56,25 @@ func Defaults() *Server {
 		DBPath:      "pimbin.db",
 		UploadsDir:  "uploads",
 		SiteName:    "pimbin",
+		Style:       "github",
+		DarkStyle:   "dracula",
+
+		RenderCacheSize:     64000000,
+		RenderCacheDiskSize: 1024000000,
+
+		ThumbnailSize: 256,
+
+		ExtractMaxEntries: 1000,
+		ExtractMaxSize:    1024000000,
+		ExtractMaxDepth:   16,
+
+		FetchTimeout:      60,
+		FetchMaxRedirects: 5,
+
+		SearchMaxSize: 1000000,
+
+		TusMaxSize: 512000000,
+		TusExpiry:  24,
 	}
 }
 
@@ -49,3 +96,35 @@ func Parse(r io.Reader) (*Server, error) {
 	}
 	return server, nil
 }
+
+// Client is the configuration of the pimbin command's client commands.
+type Client struct {
+	URL   string `toml:"url"`
+	Token string `toml:"token"`
+}
+
+// LoadClient loads the client configuration at path. Settings from the
+// PIMBIN_URL and PIMBIN_TOKEN environment variables take precedence, and
+// a missing file is the same as an empty one.
+func LoadClient(path string) (*Client, error) {
+	client := &Client{}
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		if err := toml.NewDecoder(f).Decode(client); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if url := os.Getenv("PIMBIN_URL"); url != "" {
+		client.URL = url
+	}
+	if token := os.Getenv("PIMBIN_TOKEN"); token != "" {
+		client.Token = token
+	}
+	if client.URL != "" && !strings.HasSuffix(client.URL, "/") {
+		client.URL += "/"
+	}
+	return client, nil
+}
@@ -7,7 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/mattn/go-sqlite3"
 	_ "github.com/mattn/go-sqlite3"
@@ -31,7 +33,28 @@ CREATE TABLE files (
 	FOREIGN KEY(paste) REFERENCES pastes(id) ON DELETE CASCADE
 );`
 
-var migrations = []string{""}
+var migrations = []string{
+	"",
+	`ALTER TABLE pastes ADD COLUMN url TEXT;
+	ALTER TABLE pastes ADD COLUMN clicks INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE files ADD COLUMN lang VARCHAR(64);`,
+	`ALTER TABLE pastes ADD COLUMN title TEXT;
+	ALTER TABLE pastes ADD COLUMN description TEXT;
+	CREATE TABLE tags (
+		paste CHAR(6) NOT NULL,
+		tag   VARCHAR(64) NOT NULL,
+		PRIMARY KEY(paste, tag),
+		FOREIGN KEY(paste) REFERENCES pastes(id) ON DELETE CASCADE
+	);
+	CREATE INDEX tags_tag ON tags(tag);`,
+	`ALTER TABLE pastes ADD COLUMN created INTEGER;
+	ALTER TABLE files ADD COLUMN size INTEGER;
+	ALTER TABLE files ADD COLUMN content_type VARCHAR(255);
+	ALTER TABLE files ADD COLUMN declared_type VARCHAR(255);
+	ALTER TABLE files ADD COLUMN created INTEGER;`,
+	`CREATE INDEX pastes_created ON pastes(created);`,
+	`CREATE INDEX files_hash ON files(hash);`,
+}
 
 // User contains a user's data.
 type User struct {
@@ -40,23 +63,12 @@ type User struct {
 	Token    string
 }
 
-// Paste contains a paste's data.
-type Paste struct {
-	ID    string
-	Owner string
-	Files []File
-}
-
-// File describes a paste's file.
-type File struct {
-	Hash string
-	Name string
-}
-
 // DB is a pimbin database.
 type DB struct {
 	lock sync.RWMutex
 	db   *sql.DB
+	// fts is set when SQLite was built with FTS5, which search needs.
+	fts bool
 }
 
 // OpenSQLiteDB opens and returns an sqlite3 database from the path provided.
@@ -70,9 +82,55 @@ func OpenSQLiteDB(source string) (*DB, error) {
 	if err := db.migrate(); err != nil {
 		return nil, err
 	}
+	if err := db.createSearchIndex(); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
+// createSearchIndex creates the full-text search table, if SQLite has
+// FTS5. That depends on how pimbin was built (with the sqlite_fts5 tag),
+// so it's done outside of the migrations.
+func (db *DB) createSearchIndex() error {
+	var fts bool
+	err := db.db.QueryRow(
+		"SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts)
+	if err != nil {
+		return err
+	}
+	if !fts {
+		return nil
+	}
+	// Indexes from before files' languages were stored can't have a
+	// column added, so they're started over, and backfill fills them
+	// again.
+	var outdated bool
+	err = db.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master
+		WHERE name = 'search') AND NOT EXISTS(SELECT 1
+		FROM pragma_table_info('search') WHERE name = 'lang')`).Scan(&outdated)
+	if err != nil {
+		return err
+	}
+	if outdated {
+		log.Println("search index is out of date, run pimbin backfill to rebuild it")
+		if _, err := db.db.Exec("DROP TABLE search"); err != nil {
+			return fmt.Errorf("couldn't drop old search index: %v", err)
+		}
+	}
+	_, err = db.db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS search USING fts5(
+		paste UNINDEXED,
+		hash UNINDEXED,
+		lang UNINDEXED,
+		name,
+		content
+	)`)
+	if err != nil {
+		return fmt.Errorf("couldn't create search index: %v", err)
+	}
+	db.fts = true
+	return nil
+}
+
 func (db *DB) migrate() error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
@@ -95,7 +153,10 @@ func (db *DB) migrate() error {
 		version++
 	}
 	for version < len(migrations) {
-		tx.Exec(migrations[version])
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			return fmt.Errorf("failed while migrating to version %d: %v",
+				version+1, err)
+		}
 		version++
 	}
 	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)))
@@ -105,6 +166,23 @@ func (db *DB) migrate() error {
 	return tx.Commit()
 }
 
+// fromUnixPtr and toUnixPtr convert times to and from the Unix times that
+// they're stored as, with NULL for the zero time.
+func fromUnixPtr(ptr *int64) time.Time {
+	if ptr == nil {
+		return time.Time{}
+	}
+	return time.Unix(*ptr, 0).UTC()
+}
+
+func toUnixPtr(t time.Time) *int64 {
+	if t.IsZero() {
+		return nil
+	}
+	u := t.Unix()
+	return &u
+}
+
 func fromStringPtr(ptr *string) string {
 	if ptr == nil {
 		return ""
@@ -210,72 +288,517 @@ func (db *DB) UpdatePassword(user *User) error {
 func (db *DB) PutPaste(p Paste) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	_, err := db.db.Exec("INSERT INTO pastes(id,owner) VALUES(?, ?)", p.ID, p.Owner)
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO pastes(id,owner,url,title,description,created)
+		VALUES(?, ?, ?, ?, ?, ?)`, p.ID, p.Owner, toStringPtr(p.URL),
+		toStringPtr(p.Title), toStringPtr(p.Description), toUnixPtr(p.Created))
 	if err != nil {
 		return err
 	}
-	stmt, err := db.db.Prepare("INSERT INTO files(paste, hash, name) VALUES (?, ?, ?)")
+	stmt, err := tx.Prepare(`INSERT INTO files(paste, hash, name, lang, size,
+		content_type, declared_type, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 	for _, f := range p.Files {
-		if _, err = stmt.Exec(p.ID, f.Hash, f.Name); err != nil {
+		_, err = stmt.Exec(p.ID, f.Hash, f.Name, toStringPtr(f.Lang), f.Size,
+			toStringPtr(f.ContentType), toStringPtr(f.DeclaredType),
+			toUnixPtr(f.Created))
+		if err != nil {
+			return err
+		}
+	}
+	if err := putTags(tx, p.ID, p.Tags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func putTags(tx *sql.Tx, id string, tags []string) error {
+	for _, t := range tags {
+		if _, err := tx.Exec("INSERT INTO tags(paste, tag) VALUES (?, ?)", id, t); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// UpdatePaste changes a paste's title, description and tags to those of
+// p.
+func (db *DB) UpdatePaste(p Paste) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE pastes SET title = ?, description = ? WHERE id = ?",
+		toStringPtr(p.Title), toStringPtr(p.Description), p.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM tags WHERE paste = ?", p.ID); err != nil {
+		return err
+	}
+	if err := putTags(tx, p.ID, p.Tags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pasteFile is a file and the ID of the paste that it's in.
+type pasteFile struct {
+	Paste string
+	File  File
+}
+
+// undescribedPastes returns the IDs of the pastes that were made before
+// their creation times were stored.
+func (db *DB) undescribedPastes() ([]string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	rows, err := db.db.Query("SELECT id FROM pastes WHERE created IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (db *DB) setPasteCreated(id string, created time.Time) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, err := db.db.Exec("UPDATE pastes SET created = ? WHERE id = ?",
+		toUnixPtr(created), id)
+	return err
+}
+
+// undescribedFiles returns the files that were uploaded before their
+// sizes and types were stored.
+func (db *DB) undescribedFiles() ([]pasteFile, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	rows, err := db.db.Query(`SELECT paste,hash,name,lang,size,content_type,
+		declared_type,created FROM files WHERE size IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []pasteFile
+	for rows.Next() {
+		var (
+			paste string
+			cols  fileColumns
+		)
+		if err := rows.Scan(append([]interface{}{&paste}, cols.dest()...)...); err != nil {
+			return nil, err
+		}
+		files = append(files, pasteFile{Paste: paste, File: cols.file()})
+	}
+	return files, rows.Err()
+}
+
+// unindexedFiles returns the text files that aren't in the search index,
+// such as those uploaded before pimbin was built with FTS5. Files whose
+// types aren't known yet are included, since they might be text.
+func (db *DB) unindexedFiles() ([]pasteFile, error) {
+	if !db.fts {
+		return nil, ErrNoSearch
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	rows, err := db.db.Query(`SELECT files.paste,files.hash,files.name,
+		files.lang,files.size,files.content_type,files.declared_type,
+		files.created FROM files
+		LEFT JOIN search ON search.paste = files.paste
+			AND search.hash = files.hash AND search.name = files.name
+		WHERE search.rowid IS NULL AND (files.content_type IS NULL
+			OR files.content_type LIKE 'text/%')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []pasteFile
+	for rows.Next() {
+		var (
+			paste string
+			cols  fileColumns
+		)
+		if err := rows.Scan(append([]interface{}{&paste}, cols.dest()...)...); err != nil {
+			return nil, err
+		}
+		files = append(files, pasteFile{Paste: paste, File: cols.file()})
+	}
+	return files, rows.Err()
+}
+
+// describeFile stores the size, content type and creation time of a
+// file in a paste.
+func (db *DB) describeFile(paste string, f File) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, err := db.db.Exec(`UPDATE files SET size = ?, content_type = ?,
+		created = ? WHERE paste = ? AND hash = ? AND name = ?`,
+		f.Size, toStringPtr(f.ContentType), toUnixPtr(f.Created),
+		paste, f.Hash, f.Name)
+	return err
+}
+
 // Paste returns a paste from its ID.
 func (db *DB) Paste(id string) (*Paste, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	var owner string
-	row := db.db.QueryRow("SELECT owner FROM pastes WHERE id=?", id)
-	err := row.Scan(&owner)
+	var (
+		owner       string
+		url         *string
+		clicks      int64
+		title       *string
+		description *string
+		created     *int64
+	)
+	row := db.db.QueryRow(`SELECT owner,url,clicks,title,description,created
+		FROM pastes WHERE id=?`, id)
+	err := row.Scan(&owner, &url, &clicks, &title, &description, &created)
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := db.db.Query("SELECT hash,name FROM files WHERE paste=?", id)
+	rows, err := db.db.Query(`SELECT hash,name,lang,size,content_type,
+		declared_type,created FROM files WHERE paste=?`, id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	paste := &Paste{
-		ID:    id,
-		Owner: owner,
+		ID:          id,
+		Owner:       owner,
+		URL:         fromStringPtr(url),
+		Clicks:      clicks,
+		Title:       fromStringPtr(title),
+		Description: fromStringPtr(description),
+		Created:     fromUnixPtr(created),
 	}
 	for rows.Next() {
-		var (
-			hash string
-			name string
-		)
-		if err := rows.Scan(&hash, &name); err != nil {
+		var cols fileColumns
+		if err := rows.Scan(cols.dest()...); err != nil {
 			return nil, err
 		}
-		file := File{
-			Hash: hash,
-			Name: name,
-		}
-		paste.Files = append(paste.Files, file)
+		paste.Files = append(paste.Files, cols.file())
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+
+	tags, err := db.db.Query("SELECT tag FROM tags WHERE paste=? ORDER BY tag", id)
+	if err != nil {
+		return nil, err
+	}
+	defer tags.Close()
+	for tags.Next() {
+		var tag string
+		if err := tags.Scan(&tag); err != nil {
+			return nil, err
+		}
+		paste.Tags = append(paste.Tags, tag)
+	}
+	if err := tags.Err(); err != nil {
+		return nil, err
+	}
 	return paste, nil
 }
 
+// fileColumns holds the hash, name, lang, size, content_type,
+// declared_type and created columns of a file as they're scanned.
+type fileColumns struct {
+	hash         string
+	name         string
+	lang         *string
+	size         *int64
+	contentType  *string
+	declaredType *string
+	created      *int64
+}
+
+func (c *fileColumns) dest() []interface{} {
+	return []interface{}{&c.hash, &c.name, &c.lang, &c.size, &c.contentType,
+		&c.declaredType, &c.created}
+}
+
+func (c *fileColumns) file() File {
+	f := File{
+		Hash:         c.hash,
+		Name:         c.name,
+		Lang:         fromStringPtr(c.lang),
+		ContentType:  fromStringPtr(c.contentType),
+		DeclaredType: fromStringPtr(c.declaredType),
+		Created:      fromUnixPtr(c.created),
+	}
+	if c.size != nil {
+		f.Size = *c.size
+	}
+	return f
+}
+
+// BlobUsed reports whether any paste has a file with the given hash.
+func (db *DB) BlobUsed(hash string) (bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	var used bool
+	err := db.db.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE hash = ?)",
+		hash).Scan(&used)
+	return used, err
+}
+
+// File returns a file with the given hash and name from any paste. Since
+// the blob is the same, any of them will do.
+func (db *DB) File(hash, name string) (*File, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	row := db.db.QueryRow(`SELECT hash,name,lang,size,content_type,
+		declared_type,created FROM files WHERE hash=? AND name=? LIMIT 1`,
+		hash, name)
+	var cols fileColumns
+	if err := row.Scan(cols.dest()...); err != nil {
+		return nil, err
+	}
+	f := cols.file()
+	return &f, nil
+}
+
+// Pastes lists the pastes that belong to owner, newest first. If tag
+// isn't empty, only pastes with that tag are listed.
+func (db *DB) Pastes(owner, tag string) ([]Paste, error) {
+	query := "SELECT id FROM pastes WHERE owner=?"
+	args := []interface{}{owner}
+	if tag != "" {
+		query += " AND id IN (SELECT paste FROM tags WHERE tag=?)"
+		args = append(args, tag)
+	}
+	query += " ORDER BY rowid DESC"
+	db.lock.RLock()
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		db.lock.RUnlock()
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			db.lock.RUnlock()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	db.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	pastes := make([]Paste, 0, len(ids))
+	for _, id := range ids {
+		p, err := db.Paste(id)
+		if err == sql.ErrNoRows {
+			// Deleted since it was listed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		pastes = append(pastes, *p)
+	}
+	return pastes, nil
+}
+
+// CountClick records a visit to a short link.
+func (db *DB) CountClick(id string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, err := db.db.Exec("UPDATE pastes SET clicks = clicks + 1 WHERE id = ?", id)
+	return err
+}
+
 // DeletePaste deletes a paste and its file entries by the id.
 func (db *DB) DeletePaste(id string) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	_, err := db.db.Exec("DELETE FROM paste WHERE id = ?", id)
+	tx, err := db.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM files WHERE paste = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM tags WHERE paste = ?", id); err != nil {
+		return err
+	}
+	if db.fts {
+		if _, err := tx.Exec("DELETE FROM search WHERE paste = ?", id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM pastes WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ErrNoSearch is returned when searching isn't possible because SQLite
+// was built without FTS5.
+var ErrNoSearch = errors.New("search is not available")
+
+// IndexFile adds the contents of one of a paste's files to the search
+// index, to be found under the given language.
+func (db *DB) IndexFile(paste string, f File, lang, content string) error {
+	if !db.fts {
+		return ErrNoSearch
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, err := db.db.Exec(
+		"INSERT INTO search(paste, hash, lang, name, content) VALUES (?, ?, ?, ?, ?)",
+		paste, f.Hash, lang, f.Name, content)
+	return err
+}
+
+// SearchQuery is a search for files.
+type SearchQuery struct {
+	// Terms are words that files must contain, in their name or contents.
+	Terms []string
+	// Owner limits the search to one user's pastes, if it's not empty.
+	Owner string
+	// Lang limits the search to files in a language, whether they were
+	// uploaded as it or it was worked out from their names.
+	Lang string
+	// Name limits the search to files with names containing it.
+	Name string
+	// Since and Until, if they're set, limit the search to pastes made
+	// at or after Since and before Until. Pastes from before creation
+	// times were stored are left out until they're backfilled.
+	Since time.Time
+	Until time.Time
+	// Limit is the largest number of results to return.
+	Limit int
+}
+
+// SearchResult is a file found by a search.
+type SearchResult struct {
+	Paste string
+	File  File
+	// Created is when the paste was made, if that's known.
+	Created time.Time
+	// Snippet is the part of the file that matched, with the matching
+	// words between SnippetStart and SnippetEnd.
+	Snippet string
+}
+
+// The markers around matches in snippets, from Unicode's private use
+// area so that they won't turn up in files.
+const (
+	SnippetStart = "\ue000"
+	SnippetEnd   = "\ue001"
+)
+
+// Search searches the indexed files, returning the best matches first.
+func (db *DB) Search(q SearchQuery) ([]SearchResult, error) {
+	if !db.fts {
+		return nil, ErrNoSearch
+	}
+	// Without any terms there's nothing to make a snippet around, so
+	// results start with the file's beginning instead.
+	snippet := "substr(search.content, 1, 200)"
+	if len(q.Terms) > 0 {
+		snippet = "snippet(search, 4, ?, ?, '…', 24)"
+	}
+	query := `SELECT search.paste, search.hash, search.name, search.lang,
+		pastes.created, ` + snippet + `
+		FROM search
+		JOIN pastes ON pastes.id = search.paste
+		JOIN files ON files.paste = search.paste AND files.hash = search.hash
+			AND files.name = search.name
+		WHERE 1`
+	var args []interface{}
+	if len(q.Terms) > 0 {
+		args = append(args, SnippetStart, SnippetEnd)
+		// Each term is quoted, so that nothing in it is taken for FTS5's
+		// query syntax.
+		terms := make([]string, len(q.Terms))
+		for i, t := range q.Terms {
+			terms[i] = `"` + strings.Replace(t, `"`, `""`, -1) + `"`
+		}
+		query += " AND search MATCH ?"
+		args = append(args, strings.Join(terms, " "))
+	}
+	if q.Owner != "" {
+		query += " AND pastes.owner = ?"
+		args = append(args, q.Owner)
+	}
+	if q.Lang != "" {
+		query += " AND search.lang = ?"
+		args = append(args, q.Lang)
+	}
+	if q.Name != "" {
+		query += " AND instr(search.name, ?) > 0"
+		args = append(args, q.Name)
+	}
+	if !q.Since.IsZero() {
+		query += " AND pastes.created >= ?"
+		args = append(args, q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		query += " AND pastes.created < ?"
+		args = append(args, q.Until.Unix())
+	}
+	if len(q.Terms) > 0 {
+		query += " ORDER BY rank"
+	} else {
+		query += " ORDER BY search.rowid DESC"
+	}
+	query += " LIMIT ?"
+	args = append(args, q.Limit)
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var (
+			r       SearchResult
+			lang    *string
+			created *int64
+		)
+		err := rows.Scan(&r.Paste, &r.File.Hash, &r.File.Name, &lang, &created,
+			&r.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		r.File.Lang = fromStringPtr(lang)
+		r.Created = fromUnixPtr(created)
+		results = append(results, r)
+	}
+	return results, rows.Err()
 }
 
 // Close closes the DB.
@@ -0,0 +1,168 @@
+package pimbin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errArchiveEmpty  = errors.New("archive contains no files")
+	errArchiveFormat = errors.New("unsupported archive format")
+	errArchiveLimit  = errors.New("archive exceeds extraction limits")
+	errArchivePath   = errors.New("archive contains an invalid path")
+)
+
+// extractArchive unpacks the zip, tar or gzipped tar blob with the given
+// hash, storing each regular file in it as its own blob. Directories,
+// links and other special entries are skipped. If strip is set, image
+// metadata is removed from the unpacked files. The files stored are
+// returned even if it fails, so that the caller can release them along
+// with the archive's blob.
+func (s *Server) extractArchive(hash string, strip bool) ([]File, error) {
+	f, err := os.Open(filepath.Join(s.Config.UploadsDir, hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var magic [262]byte
+	n, _ := io.ReadFull(f, magic[:])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	x := &extractor{
+		srv:    s,
+		strip:  strip,
+		budget: &limitReader{n: s.Config.ExtractMaxSize, err: errArchiveLimit},
+	}
+	switch {
+	case bytes.HasPrefix(magic[:n], []byte("PK\x03\x04")),
+		// An empty zip is nothing but its end of central directory.
+		bytes.HasPrefix(magic[:n], []byte("PK\x05\x06")):
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			err = x.extractZip(f, info.Size())
+		}
+	case bytes.HasPrefix(magic[:n], []byte("\x1f\x8b")):
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(f); err == nil {
+			err = x.extractTar(gz)
+			gz.Close()
+		} else {
+			err = errArchiveFormat
+		}
+	case n == len(magic) && string(magic[257:262]) == "ustar":
+		err = x.extractTar(f)
+	default:
+		err = errArchiveFormat
+	}
+	if err == nil && len(x.files) == 0 {
+		err = errArchiveEmpty
+	}
+	return x.files, err
+}
+
+// fileHashes returns the hashes of files.
+func fileHashes(files []File) []string {
+	hashes := make([]string, len(files))
+	for i, f := range files {
+		hashes[i] = f.Hash
+	}
+	return hashes
+}
+
+type extractor struct {
+	srv    *Server
+	strip  bool
+	files  []File
+	budget *limitReader
+}
+
+func (x *extractor) extractZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errArchiveFormat
+	}
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			// Most likely a compression method that isn't supported.
+			return errArchiveFormat
+		}
+		err = x.add(zf.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// A gzipped file that isn't a tar ends up here too.
+			return errArchiveFormat
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err := x.add(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) add(name string, r io.Reader) error {
+	name, ok := cleanName(name)
+	if !ok {
+		return errArchivePath
+	}
+	cfg := x.srv.Config
+	if len(x.files) >= cfg.ExtractMaxEntries ||
+		strings.Count(name, "/") >= cfg.ExtractMaxDepth {
+		return errArchiveLimit
+	}
+	x.budget.r = r
+	hash, _, err := x.srv.storeFile(x.budget, x.strip)
+	if err != nil {
+		return err
+	}
+	x.files = append(x.files, File{Hash: hash, Name: name})
+	return nil
+}
+
+// limitReader is like io.LimitedReader, but fails with err instead of
+// stopping quietly once more than n bytes have been read.
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return 0, l.err
+	}
+	return n, err
+}
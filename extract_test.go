@@ -0,0 +1,277 @@
+package pimbin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erebid/pimbin/config"
+)
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"dir/a.txt", "dir/a.txt", true},
+		{"dir//./a.txt", "dir/a.txt", true},
+		{"", "", false},
+		{".", "", false},
+		{"./", "", false},
+		{"/etc/passwd", "", false},
+		{"../a.txt", "", false},
+		{"dir/../../a.txt", "", false},
+		{"dir/../a.txt", "", false},
+		{`dir\a.txt`, "", false},
+		{strings.Repeat("a", maxNameLen), strings.Repeat("a", maxNameLen), true},
+		{strings.Repeat("a", maxNameLen+1), "", false},
+	}
+	for _, tt := range tests {
+		got, ok := cleanName(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cleanName(%q) = %q, %t, want %q, %t", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+type archiveEntry struct {
+	name, body string
+}
+
+func makeZip(t *testing.T, entries []archiveEntry) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func makeTarGz(t *testing.T, entries []archiveEntry) []byte {
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	// A directory, which is skipped.
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755})
+	for _, e := range entries {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.name,
+			Size:     int64(len(e.body)),
+			Mode:     0644,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+	gw.Close()
+	return b.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	entries := []archiveEntry{
+		{"a.txt", "first file\n"},
+		{"dir/b.txt", "second file\n"},
+	}
+	for _, format := range []struct {
+		name string
+		make func(*testing.T, []archiveEntry) []byte
+	}{{"zip", makeZip}, {"tar.gz", makeTarGz}} {
+		t.Run(format.name, func(t *testing.T) {
+			s, cleanup := newTestServer(t, nil)
+			defer cleanup()
+			hash, err := s.downloadFile(bytes.NewReader(format.make(t, entries)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := s.extractArchive(hash, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(entries) {
+				t.Fatalf("got %d files, want %d", len(files), len(entries))
+			}
+			for i, f := range files {
+				if f.Name != entries[i].name {
+					t.Errorf("file %d is named %q, want %q", i, f.Name, entries[i].name)
+				}
+				b, err := ioutil.ReadFile(filepath.Join(s.Config.UploadsDir, f.Hash))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != entries[i].body {
+					t.Errorf("%s contains %q, want %q", f.Name, b, entries[i].body)
+				}
+			}
+		})
+	}
+}
+
+func gzipped(t *testing.T, data string) []byte {
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	gw.Write([]byte(data))
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestExtractArchiveErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive []byte
+		limit   func(*config.Server)
+		err     error
+	}{
+		{
+			name:    "path outside the paste",
+			archive: makeZip(t, []archiveEntry{{"ok.txt", "ok\n"}, {"../evil", "evil\n"}}),
+			err:     errArchivePath,
+		},
+		{
+			name:    "absolute path",
+			archive: makeZip(t, []archiveEntry{{"ok.txt", "ok\n"}, {"/etc/evil", "evil\n"}}),
+			err:     errArchivePath,
+		},
+		{
+			name:    "too many entries",
+			archive: makeZip(t, []archiveEntry{{"1.txt", "ok\n"}, {"2.txt", "2\n"}, {"3.txt", "3\n"}}),
+			limit:   func(cfg *config.Server) { cfg.ExtractMaxEntries = 2 },
+			err:     errArchiveLimit,
+		},
+		{
+			name:    "too large",
+			archive: makeZip(t, []archiveEntry{{"a.txt", "ok\n"}, {"b.txt", strings.Repeat("x", 100)}}),
+			limit:   func(cfg *config.Server) { cfg.ExtractMaxSize = 50 },
+			err:     errArchiveLimit,
+		},
+		{
+			name:    "too deep",
+			archive: makeZip(t, []archiveEntry{{"a/b/c/d.txt", "ok\n"}}),
+			limit:   func(cfg *config.Server) { cfg.ExtractMaxDepth = 2 },
+			err:     errArchiveLimit,
+		},
+		{
+			name:    "not an archive",
+			archive: []byte("ok\n"),
+			err:     errArchiveFormat,
+		},
+		{
+			name:    "gzipped file that isn't a tar",
+			archive: gzipped(t, "ok\n"),
+			err:     errArchiveFormat,
+		},
+		{
+			name:    "truncated zip",
+			archive: makeZip(t, []archiveEntry{{"a.txt", "ok\n"}})[:30],
+			err:     errArchiveFormat,
+		},
+		{
+			name:    "empty zip",
+			archive: makeZip(t, nil),
+			err:     errArchiveEmpty,
+		},
+		{
+			name:    "only a directory",
+			archive: makeTarGz(t, nil),
+			err:     errArchiveEmpty,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cleanup := newTestServer(t, tt.limit)
+			defer cleanup()
+			hash, err := s.downloadFile(bytes.NewReader(tt.archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := s.extractArchive(hash, false)
+			if err != tt.err {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+
+			// Uploading it fails, and removes everything it stored except
+			// what another paste has.
+			shared, err := s.downloadFile(strings.NewReader("ok\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.db.PutPaste(Paste{ID: "shared", Files: []File{{Hash: shared, Name: "a"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.releaseBlobs(append(fileHashes(files), hash, shared), nil)
+			w := upload(s, formField{"x", "", "1"}, formField{"file", "a.zip", string(tt.archive)})
+			if w.Code != 400 || strings.TrimSpace(w.Body.String()) != tt.err.Error() {
+				t.Errorf("uploading: got status %d: %s", w.Code, w.Body)
+			}
+			left := blobs(t, s)
+			if len(left) != 1 || !left[shared] {
+				t.Errorf("got blobs %v after failing, want only %s", left, shared)
+			}
+		})
+	}
+}
+
+func TestUploadExtract(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	archive := string(makeZip(t, []archiveEntry{{"a.txt", "first\n"}, {"dir/b.txt", "second\n"}}))
+
+	p := uploaded(t, s, upload(s, formField{"x", "", "1"}, formField{"file", "a.zip", archive}))
+	if len(p.Files) != 2 {
+		t.Fatalf("got files %+v", p.Files)
+	}
+	if left := blobs(t, s); len(left) != 2 {
+		t.Errorf("got blobs %v, want only the unpacked files", left)
+	}
+
+	// The same archive, unpacked and as it is. The archive's blob is
+	// still needed for the second file.
+	p = uploaded(t, s, upload(s, formField{"x:1", "", "1"},
+		formField{"file:1", "a.zip", archive}, formField{"file:2", "b.zip", archive}))
+	if len(p.Files) != 3 || p.Files[2].Name != "b.zip" {
+		t.Fatalf("got files %+v", p.Files)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.Config.UploadsDir, p.Files[2].Hash))
+	if err != nil || string(b) != archive {
+		t.Errorf("b.zip contains %q, error %v", b, err)
+	}
+}
+
+func TestUploadExtractHeld(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	archive := makeZip(t, []archiveEntry{{"a.txt", "first\n"}})
+	// Another request that has stored the same archive, but hasn't made
+	// its paste yet.
+	hash, err := s.downloadFile(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded(t, s, upload(s, formField{"x", "", "1"}, formField{"file", "a.zip", string(archive)}))
+	if !blobs(t, s)[hash] {
+		t.Fatal("a blob held by another request was removed")
+	}
+	s.releaseBlobs([]string{hash}, nil)
+	if blobs(t, s)[hash] {
+		t.Error("the archive's blob was kept after everything let go of it")
+	}
+}
@@ -0,0 +1,148 @@
+package pimbin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/erebid/pimbin/config"
+)
+
+var (
+	errFetchURL      = errors.New("invalid fetch URL")
+	errFetchBlocked  = errors.New("fetching from this address is not allowed")
+	errFetchTooLarge = errors.New("fetched file is too large")
+)
+
+// privateNets are the private address ranges (RFC 1918 and RFC 4193) and
+// the carrier-grade NAT range, which net.IP has no predicates for.
+var privateNets = []*net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IP{0xfc, 15: 0}, Mask: net.CIDRMask(7, 128)},
+}
+
+// fetchFile downloads rawurl and saves it with storeFile. Besides the
+// file's hash and content type, it returns a name taken from the URL's
+// path, which may be empty. It downloads no more than *budget bytes, and
+// takes the file's size off *budget, so that every fetch in an upload
+// shares one limit.
+func (s *Server) fetchFile(ctx context.Context, rawurl string, strip bool, budget *int64) (hash, ctype, name string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", "", "", errFetchURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", "", "", errFetchURL
+	}
+	resp, err := s.fetcher.Do(req)
+	if err != nil {
+		// The client wraps errors from dialing and redirects.
+		for _, e := range []error{errFetchBlocked, errFetchURL} {
+			if errors.Is(err, e) {
+				return "", "", "", e
+			}
+		}
+		return "", "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", "", fmt.Errorf("fetch failed: %s", resp.Status)
+	}
+	if resp.ContentLength > *budget {
+		return "", "", "", errFetchTooLarge
+	}
+	body := &limitReader{
+		r:   resp.Body,
+		n:   *budget,
+		err: errFetchTooLarge,
+	}
+	hash, ctype, err = s.storeFile(body, strip)
+	if err != nil {
+		return "", "", "", err
+	}
+	*budget = body.n
+	// The name comes from the final URL, after any redirects.
+	if n, ok := cleanName(path.Base(resp.Request.URL.Path)); ok {
+		name = n
+	}
+	return hash, ctype, name, nil
+}
+
+// newFetchClient returns an HTTP client for fetchFile, which refuses to
+// connect to private, loopback and other internal addresses unless they're
+// allowed in the configuration. It's made once, so that its connections
+// are reused and idle ones are closed.
+func newFetchClient(cfg config.Server) *http.Client {
+	var allow []*net.IPNet
+	for _, cidr := range cfg.FetchAllow {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			allow = append(allow, n)
+		}
+	}
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		// Control is called with the resolved address of every
+		// connection, so a name that resolves to a blocked address is
+		// caught too.
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !fetchAllowed(ip, allow) {
+				return errFetchBlocked
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: time.Duration(cfg.FetchTimeout) * time.Second,
+		Transport: &http.Transport{
+			// Going through a proxy would get around the address checks.
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.FetchMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errFetchURL
+			}
+			return nil
+		},
+	}
+}
+
+func fetchAllowed(ip net.IP, allow []*net.IPNet) bool {
+	for _, n := range allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
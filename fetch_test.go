@@ -0,0 +1,181 @@
+package pimbin
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erebid/pimbin/config"
+)
+
+// fetchServer returns a server that can fetch files into a temporary
+// uploads directory, and a function that removes it.
+func fetchServer(t *testing.T, cfg *config.Server) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "pimbin-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.UploadsDir = dir
+	s := &Server{Config: *cfg, fetcher: newFetchClient(*cfg), blobHolds: make(map[string]int)}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestFetchFile(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello, world\n"))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 100)))
+	})
+	mux.HandleFunc("/big-chunked", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before the end means there's no Content-Length.
+		w.Write([]byte(strings.Repeat("a", 50)))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat("a", 50)))
+	})
+	mux.HandleFunc("/to-blocked", func(w http.ResponseWriter, r *http.Request) {
+		_, port, _ := net.SplitHostPort(r.Host)
+		http.Redirect(w, r, "http://127.0.0.2:"+port+"/hello.txt", http.StatusFound)
+	})
+	mux.HandleFunc("/to-ftp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://example.com/file", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		allow   []string
+		maxSize int64
+		err     error
+	}{
+		{"loopback blocked", "/hello.txt", nil, 0, errFetchBlocked},
+		{"loopback allowed", "/hello.txt", []string{"127.0.0.1/32"}, 0, nil},
+		{"redirect to blocked address", "/to-blocked", []string{"127.0.0.1/32"}, 0, errFetchBlocked},
+		{"redirect to other scheme", "/to-ftp", []string{"127.0.0.1/32"}, 0, errFetchURL},
+		{"too large", "/big", []string{"127.0.0.1/32"}, 99, errFetchTooLarge},
+		{"too large without length", "/big-chunked", []string{"127.0.0.1/32"}, 99, errFetchTooLarge},
+		{"just small enough", "/big", []string{"127.0.0.1/32"}, 100, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.FetchAllow = tt.allow
+			if tt.maxSize > 0 {
+				cfg.MaxBodySize = tt.maxSize
+			}
+			s, cleanup := fetchServer(t, cfg)
+			defer cleanup()
+			budget := s.Config.MaxBodySize
+			hash, _, name, err := s.fetchFile(context.Background(), ts.URL+tt.path, false, &budget)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := os.Stat(filepath.Join(s.Config.UploadsDir, hash)); err != nil {
+				t.Errorf("fetched file wasn't stored: %v", err)
+			}
+			if want := filepath.Base(tt.path); name != want {
+				t.Errorf("got name %q, want %q", name, want)
+			}
+		})
+	}
+}
+
+func TestFetchInvalidURL(t *testing.T) {
+	s, cleanup := fetchServer(t, config.Defaults())
+	defer cleanup()
+	for _, u := range []string{"", "file:///etc/passwd", "ftp://example.com/", "http://"} {
+		budget := s.Config.MaxBodySize
+		_, _, _, err := s.fetchFile(context.Background(), u, false, &budget)
+		if err != errFetchURL {
+			t.Errorf("fetching %q: got error %v, want %v", u, err, errFetchURL)
+		}
+	}
+}
+
+func TestFetchBudget(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 600)))
+	}))
+	defer ts.Close()
+	configure := func(cfg *config.Server) {
+		cfg.FetchAllow = []string{"127.0.0.1/32"}
+		cfg.MaxBodySize = 1000
+	}
+	cfg := config.Defaults()
+	configure(cfg)
+	s, cleanup := fetchServer(t, cfg)
+	defer cleanup()
+
+	budget := int64(1000)
+	if _, _, _, err := s.fetchFile(context.Background(), ts.URL+"/a", false, &budget); err != nil {
+		t.Fatal(err)
+	}
+	if budget != 400 {
+		t.Errorf("after fetching 600 bytes: got a budget of %d, want 400", budget)
+	}
+	if _, _, _, err := s.fetchFile(context.Background(), ts.URL+"/b", false, &budget); err != errFetchTooLarge {
+		t.Errorf("fetching past the budget: got error %v, want %v", err, errFetchTooLarge)
+	}
+
+	// Every fetch in an upload counts towards the same limit.
+	s, cleanup = newTestServer(t, configure)
+	defer cleanup()
+	p := uploaded(t, s, upload(s, formField{"fetch", "", ts.URL + "/a"}))
+	if len(p.Files) != 1 || p.Files[0].Size != 600 {
+		t.Errorf("got files %+v", p.Files)
+	}
+	w := upload(s, formField{"fetch:1", "", ts.URL + "/a"}, formField{"fetch:2", "", ts.URL + "/b"})
+	if w.Code != 413 {
+		t.Errorf("fetching too much in one upload: got status %d, want 413", w.Code)
+	}
+	if left := blobs(t, s); len(left) != 1 || !left[p.Files[0].Hash] {
+		t.Errorf("got blobs %v, want only the first paste's", left)
+	}
+}
+
+func TestFetchAllowed(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.1.0.0/16")
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"172.32.0.1", true},
+		{"100.128.0.1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:192.168.0.1", false},
+	}
+	for _, tt := range tests {
+		got := fetchAllowed(net.ParseIP(tt.ip), []*net.IPNet{allowed})
+		if got != tt.want {
+			t.Errorf("fetchAllowed(%s) = %t, want %t", tt.ip, got, tt.want)
+		}
+	}
+}
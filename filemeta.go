@@ -0,0 +1,156 @@
+package pimbin
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/erebid/pimbin/config"
+)
+
+// detectType works out a file's content type from its name, or failing
+// that, its contents. r is left at the start.
+func detectType(name string, r io.ReadSeeker) (string, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	ctype := mediaTypes[ext]
+	if ctype == "" {
+		ctype = mime.TypeByExtension(ext)
+	}
+	if ctype == "" {
+		var buf [512]byte
+		n, _ := io.ReadFull(r, buf[:])
+		ctype = http.DetectContentType(buf[:n])
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	return ctype, nil
+}
+
+// declaredType cleans up a content type given by a client, returning ""
+// if it isn't a valid one.
+func declaredType(t string) string {
+	mediatype, params, err := mime.ParseMediaType(t)
+	if err != nil {
+		return ""
+	}
+	t = mime.FormatMediaType(mediatype, params)
+	if len(t) > 255 {
+		return ""
+	}
+	return t
+}
+
+// formatSize formats a number of bytes for people to read.
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(1024), 0
+	for m := n / 1024; m >= 1024 && exp < 3; m /= 1024 {
+		div *= 1024
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// describeFile records a file's size and content type, which are
+// otherwise worked out from its blob whenever it's served.
+func describeFile(uploadsDir string, f *File) error {
+	blob, err := os.Open(filepath.Join(uploadsDir, f.Hash))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	info, err := blob.Stat()
+	if err != nil {
+		return err
+	}
+	f.Size = info.Size()
+	f.ContentType, err = detectType(f.Name, blob)
+	return err
+}
+
+// describePaste records when a new paste and its files were made and
+// what its files are.
+func (s *Server) describePaste(p *Paste) error {
+	p.Created = time.Now().UTC().Truncate(time.Second)
+	for i := range p.Files {
+		if err := describeFile(s.Config.UploadsDir, &p.Files[i]); err != nil {
+			return err
+		}
+		p.Files[i].Created = p.Created
+	}
+	return nil
+}
+
+// Backfill records the metadata that's stored at upload time for pastes
+// made before it was. Pastes get the time that their IDs encode, and
+// files the blob's size and type and the paste's time. Then, if pimbin
+// has search, it indexes any text files that aren't in the index yet. It
+// returns the number of files updated and indexed.
+func Backfill(cfg config.Server, db *DB) (described, indexed int, err error) {
+	described, err = describeOld(cfg, db)
+	if err != nil {
+		return described, 0, err
+	}
+	files, err := db.unindexedFiles()
+	if err == ErrNoSearch {
+		return described, 0, nil
+	} else if err != nil {
+		return described, 0, err
+	}
+	for _, f := range files {
+		ok, err := indexFile(cfg, db, f.Paste, f.File)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return described, indexed, err
+		}
+		if ok {
+			indexed++
+		}
+	}
+	return described, indexed, nil
+}
+
+func describeOld(cfg config.Server, db *DB) (int, error) {
+	pastes, err := db.undescribedPastes()
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range pastes {
+		created, ok := pasteTime(id)
+		if !ok {
+			continue
+		}
+		if err := db.setPasteCreated(id, created); err != nil {
+			return 0, err
+		}
+	}
+
+	files, err := db.undescribedFiles()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		err := describeFile(cfg.UploadsDir, &f.File)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		f.File.Created, _ = pasteTime(f.Paste)
+		if err := db.describeFile(f.Paste, f.File); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
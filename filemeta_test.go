@@ -0,0 +1,153 @@
+package pimbin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeclaredType(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"text/plain", "text/plain"},
+		{"Text/Plain; Charset=UTF-8", "text/plain; charset=UTF-8"},
+		{"image/png ", "image/png"},
+		{"", ""},
+		{"not a type", ""},
+		{"text/plain; charset", ""},
+		{"application/" + strings.Repeat("x", 255), ""},
+	}
+	for _, tt := range tests {
+		if got := declaredType(tt.in); got != tt.want {
+			t.Errorf("declaredType(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+		{2 << 40, "2.0 TiB"},
+		{2048 << 40, "2048.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDetectType(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"a.mp3", "", "audio/mpeg"},
+		{"A.MKV", "", "video/x-matroska"},
+		{"a.png", "not really", "image/png"},
+		{"noext", "\x89PNG\r\n\x1a\n", "image/png"},
+		{"noext", "hello\n", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		r := strings.NewReader(tt.content)
+		got, err := detectType(tt.name, r)
+		if err != nil {
+			t.Errorf("detectType(%q): %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("detectType(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if r.Len() != len(tt.content) {
+			t.Errorf("detectType(%q) didn't seek back to the start", tt.name)
+		}
+	}
+}
+
+func TestUploadMetadata(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	before := time.Now().Add(-time.Second)
+	p := uploaded(t, s, upload(s, formField{"file", "a.go", "package a\n"}))
+	if p.Created.Before(before) || p.Created.After(time.Now()) {
+		t.Errorf("paste was created at %v", p.Created)
+	}
+	f := p.Files[0]
+	if f.Size != 10 || !strings.HasPrefix(f.ContentType, "text/") ||
+		f.DeclaredType != "application/octet-stream" || !f.Created.Equal(p.Created) {
+		t.Errorf("got file %+v", f)
+	}
+
+	// The stored type is what's served, rather than one worked out again.
+	if _, err := s.db.db.Exec("UPDATE files SET content_type = 'image/png'"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/raw/"+f.Hash+"/a.go", nil))
+	if got := w.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("raw file was served as %q", got)
+	}
+	if got := w.Header().Get("Last-Modified"); got != p.Created.UTC().Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q, want the upload time", got)
+	}
+	// Files that aren't in a paste under that name are worked out from
+	// the name in the URL, unescaped.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/raw/"+f.Hash+"/x%2Emp3", nil))
+	if got := w.Header().Get("Content-Type"); got != "audio/mpeg" {
+		t.Errorf("raw file with another name was served as %q", got)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	hash, err := s.downloadFile(strings.NewReader("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A paste from before metadata was stored, with a file whose blob is
+	// missing.
+	id := s.id()
+	_, err = s.db.db.Exec(`INSERT INTO pastes(id, owner) VALUES (?, '');
+		INSERT INTO files(paste, hash, name) VALUES (?, ?, 'a.txt'), (?, 'missing', 'b.txt');`,
+		id, id, hash, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	described, _, err := Backfill(s.Config, s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if described != 1 {
+		t.Errorf("described %d files, want 1", described)
+	}
+	p, err := s.db.Paste(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, _ := pasteTime(id)
+	if !p.Created.Equal(created) {
+		t.Errorf("paste was created at %v, want %v", p.Created, created)
+	}
+	f := p.Files[0]
+	if f.Size != 6 || f.ContentType != "text/plain; charset=utf-8" || !f.Created.Equal(created) {
+		t.Errorf("got file %+v", f)
+	}
+
+	// Running it again has nothing left to do.
+	if described, _, err := Backfill(s.Config, s.db); err != nil || described != 0 {
+		t.Errorf("backfilling again described %d files, error %v", described, err)
+	}
+}
@@ -7,5 +7,6 @@ require (
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/pelletier/go-toml v1.8.0
+	github.com/yuin/goldmark v1.4.13
 	golang.org/x/crypto v0.1.0
 )
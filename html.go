@@ -1,10 +1,13 @@
 package pimbin
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 
 	stdhtml "html"
@@ -12,101 +15,218 @@ import (
 	"github.com/alecthomas/chroma"
 	"github.com/alecthomas/chroma/formatters/html"
 	"github.com/alecthomas/chroma/lexers"
-	"github.com/alecthomas/chroma/styles"
 )
 
-type pasteView struct {
-	SiteName string
-	BaseURL  string
-	Paste    Paste
+// renderOptions are a request's options for how files are rendered.
+type renderOptions struct {
+	// Source shows files like Markdown as highlighted source code
+	// instead of rendering them.
+	Source bool
+	// Style is the highlighting style chosen by the viewer, if any.
+	Style *chroma.Style
+	// Langs are languages to highlight files as, by file name, instead
+	// of the ones they were uploaded with. The language for the empty
+	// name applies to all files.
+	Langs map[string]string
+	// Highlight are the line ranges to highlight, by file name, with
+	// the ranges for the empty name applying to all files.
+	Highlight map[string][][2]int
 }
 
-const pasteTemplate = `{{ define "paste" }}
-<!DOCTYPE html>
-<html>
-<head>
-  <meta charset="UTF-8">
-  <link rel="stylesheet" href="{{ .BaseURL }}style.css">
-  <title>{{ .SiteName }}</title>
-  <meta name="description" content = "
-{{ range .Paste.Files -}}
-- {{ .Name }}
-{{ end -}}">
-</head>
-<body>
-{{ if lt 1 (len .Paste.Files)}}
-<h1>files</h1>
-<ul id="file-index">
-{{ range .Paste.Files }}
-<li>
-<a href="#{{.Name}}">{{.Name}}</a>
-</li>
-{{ end }}
-</ul>
-{{ end }}
-{{ range .Paste.Files}}
-{{ if lt 1 (len $.Paste.Files)}}
-{{ end }}
-<h1 id="{{.Name}}" class="filename">{{.Name}}</h1>
-<a href="{{ $.BaseURL }}raw/{{ .Hash }}/{{ .Name }}">raw</a>
-{{ renderFile . }}
-{{ end }}
-</body>
-</html>
-{{end}}`
-
-func (s *Server) renderPaste(w http.ResponseWriter, p *Paste) {
-	funcMap := template.FuncMap{"renderFile": s.renderFile}
-	t, err := template.New("paste").Funcs(funcMap).Parse(pasteTemplate)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+// lang returns the language that a file should be highlighted as, or
+// an empty string if it should be guessed.
+func (o renderOptions) lang(f File) string {
+	if lang, ok := o.Langs[f.Name]; ok {
+		return lang
 	}
-	err = t.ExecuteTemplate(w, "paste", pasteView{
-		BaseURL:  s.Config.BaseURL,
-		SiteName: s.Config.SiteName,
-		Paste:    *p})
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	if lang, ok := o.Langs[""]; ok {
+		return lang
 	}
+	return f.Lang
 }
 
-func (s *Server) renderFile(f File) template.HTML {
-	lexer := lexers.Match(f.Name)
+// parseLangs parses lang query parameters, which are either a language
+// for every file or a file name and language separated by a colon.
+func parseLangs(values []string) map[string]string {
+	langs := make(map[string]string)
+	for _, v := range values {
+		var name string
+		if i := strings.LastIndex(v, ":"); i >= 0 {
+			name, v = v[:i], v[i+1:]
+		}
+		langs[name] = v
+	}
+	return langs
+}
+
+// fileLexer picks a lexer for a file, going by its language, then its
+// name, then its contents.
+func fileLexer(f File, opts renderOptions, contents string) chroma.Lexer {
+	var lexer chroma.Lexer
+	if lang := opts.lang(f); lang != "" {
+		lexer = lexers.Get(lang)
+	}
+	if lexer == nil {
+		lexer = lexers.Match(f.Name)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(contents)
+	}
 	if lexer == nil {
 		lexer = lexers.Fallback
 	}
-	lexer = chroma.Coalesce(lexer)
-	style := styles.Get("dracula")
-	if style == nil {
-		style = styles.Fallback
+	return chroma.Coalesce(lexer)
+}
+
+func (s *Server) renderPaste(w http.ResponseWriter, r *http.Request, p *Paste) {
+	opts := renderOptions{
+		Source: r.URL.Query().Get("source") != "",
+		Style:  viewerStyle(w, r),
+		Langs:  parseLangs(r.URL.Query()["lang"]),
+
+		Highlight: parseHighlights(r.URL.Query()["hl"]),
 	}
+	view := pasteView{
+		pageView: s.pageView(opts.Style),
+		Paste:    *p,
+		Tree:     buildTree(p.Files),
+		Source:   opts.Source,
+		opts:     opts,
+	}
+	if s.siteHost() != "" && siteFile(p, "index.html") != nil {
+		view.SiteURL = s.siteURL(p.ID)
+	}
+	if !s.Config.Dev {
+		etag := s.pasteETag(p, r, opts)
+		// The page can change when the paste is edited or deleted, so
+		// browsers have to check back every time.
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Vary", "Cookie")
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	s.renderPage(w, 200, "paste", view)
+}
+
+// pasteETag returns the ETag of a paste's page, which changes along with
+// the paste, the options it's rendered with and, since templates and the
+// configuration could have changed, whenever the server restarts.
+func (s *Server) pasteETag(p *Paste, r *http.Request, opts renderOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%+v\x00%s\x00%s\x00",
+		s.started.UnixNano(), *p, s.chromaStyle(opts).Name, r.URL.RawQuery)
+	return `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:18]) + `"`
+}
+
+// chromaStyle returns the style used for highlighting with opts.
+func (s *Server) chromaStyle(opts renderOptions) *chroma.Style {
+	if opts.Style != nil {
+		return opts.Style
+	}
+	return s.style
+}
+
+// viewerStyle returns the highlighting style that the viewer picked with
+// the style query parameter or cookie, remembering a new choice in the
+// cookie. "auto" forgets the choice.
+func viewerStyle(w http.ResponseWriter, r *http.Request) *chroma.Style {
+	if name := r.URL.Query().Get("style"); name == "auto" {
+		http.SetCookie(w, &http.Cookie{Name: "style", Path: "/", MaxAge: -1})
+		return nil
+	} else if style := lookupStyle(name); style != nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "style",
+			Value:    style.Name,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return style
+	}
+	if c, err := r.Cookie("style"); err == nil {
+		return lookupStyle(c.Value)
+	}
+	return nil
+}
+
+func (s *Server) renderFile(f File, opts renderOptions) template.HTML {
+	style := s.chromaStyle(opts)
+	highlight := append(opts.Highlight[""], opts.Highlight[f.Name]...)
 	formatter := html.New(
 		html.WithClasses(true),
 		html.LineNumbersInTable(true),
 		html.LinkableLineNumbers(true, stdhtml.EscapeString(f.Name+"-L")),
-		html.WithLineNumbers(true))
+		html.WithLineNumbers(true),
+		html.HighlightLines(highlight))
 	r, ctype, err := s.getPasteFile(f)
 	defer r.Close()
 	switch {
 	case strings.HasPrefix(ctype, "text/"):
 		break
+	case thumbnailTypes[ctype]:
+		return template.HTML(fmt.Sprintf(
+			`<a href="%sraw/%s"><img src="%sthumb/%s" alt="%s" loading="lazy"></a>`,
+			s.Config.BaseURL, f.Hash, s.Config.BaseURL, f.Hash,
+			stdhtml.EscapeString(f.Name)))
+	case strings.HasPrefix(ctype, "video/"):
+		return template.HTML(fmt.Sprintf(
+			`<video src="%s" controls preload="metadata"></video>`, s.rawURL(f)))
+	case strings.HasPrefix(ctype, "audio/"), ctype == "application/ogg":
+		return template.HTML(fmt.Sprintf(
+			`<audio src="%s" controls preload="metadata"></audio>`, s.rawURL(f)))
 	case strings.HasPrefix(ctype, "image/"):
 		return template.HTML(fmt.Sprintf(`<img src="%sraw/%s" alt="%s">`,
-			s.Config.BaseURL, f.Hash, f.Name))
+			s.Config.BaseURL, f.Hash, stdhtml.EscapeString(f.Name)))
 	default:
 		return template.HTML("<p>(binary file not rendered)</p>")
 	}
+	markdown := isMarkdown(f.Name) && !opts.Source && opts.lang(f) == ""
+	// Blobs never change, so this covers everything that the output
+	// depends on. The lexer is picked from the name, language and
+	// contents, so it doesn't need to be in here.
+	key := fmt.Sprintf("v1\x00%s\x00%s\x00%s\x00%s\x00%t\x00%v",
+		f.Hash, f.Name, opts.lang(f), style.Name, markdown, highlight)
+	if cached, ok := s.renderCache.Get(key); ok {
+		return template.HTML(cached)
+	}
 	contents, err := ioutil.ReadAll(r)
 	if err != nil {
 		return ""
 	}
+	if markdown {
+		rendered, err := s.renderMarkdown(contents, style)
+		if err != nil {
+			return ""
+		}
+		s.renderCache.Put(key, string(rendered))
+		return rendered
+	}
+	lexer := fileLexer(f, opts, string(contents))
 	iterator, err := lexer.Tokenise(nil, string(contents))
 	var b strings.Builder
 	err = formatter.Format(&b, style, iterator)
 	if err != nil {
 		return ""
 	}
+	s.renderCache.Put(key, b.String())
 	return template.HTML(b.String())
 }
+
+// rawURL returns the URL of a file's raw contents, escaped for HTML.
+func (s *Server) rawURL(f File) string {
+	return stdhtml.EscapeString(s.Config.BaseURL + rawPath(f))
+}
+
+// rawPath returns the path of a file's raw contents, relative to the base
+// URL. It includes the file's name, escaped, so that the content type can
+// be worked out from it.
+func rawPath(f File) string {
+	segs := strings.Split(f.Name, "/")
+	for i := range segs {
+		segs[i] = url.PathEscape(segs[i])
+	}
+	return "raw/" + f.Hash + "/" + strings.Join(segs, "/")
+}
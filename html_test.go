@@ -0,0 +1,43 @@
+package pimbin
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestViewerStyle(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	p := uploaded(t, s, upload(s, formField{"file", "a.go", "package a\n"}))
+
+	tests := []struct {
+		query  string
+		cookie string
+		set    string
+		css    string
+	}{
+		{"?style=monokai", "", "style=monokai", "style.css?style=monokai"},
+		{"?style=auto", "style=monokai", "style=; Path=/; Max-Age=0", `style.css"`},
+		{"?style=nope", "", "", `style.css"`},
+		{"", "style=monokai", "", "style.css?style=monokai"},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/" + p.ID, "/"} {
+			req := httptest.NewRequest("GET", path+tt.query, nil)
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", tt.cookie)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			cookies := w.Header()["Set-Cookie"]
+			if tt.set == "" && len(cookies) != 0 ||
+				tt.set != "" && (len(cookies) != 1 || !strings.HasPrefix(cookies[0], tt.set)) {
+				t.Errorf("%s%s: got Set-Cookie %q, want one starting with %q", path, tt.query, cookies, tt.set)
+			}
+			if !strings.Contains(w.Body.String(), tt.css) {
+				t.Errorf("%s%s: the page doesn't link to %s", path, tt.query, tt.css)
+			}
+		}
+	}
+}
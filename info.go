@@ -0,0 +1,68 @@
+package pimbin
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on what can be said about a paste.
+const (
+	maxTitleLen       = 256
+	maxDescriptionLen = 4096
+	maxTagLen         = 64
+	maxTags           = 32
+)
+
+var (
+	errTitle       = errors.New("title is too long")
+	errDescription = errors.New("description is too long")
+	errTag         = errors.New("tags must be 1 to 64 characters without spaces or commas")
+	errTooManyTags = errors.New("too many tags")
+)
+
+// cleanInfo checks the title, description and tags given for a paste,
+// tidying them up. Tags are lowercased, so that they match however
+// they're typed.
+func cleanInfo(p *Paste) error {
+	p.Title = strings.TrimSpace(p.Title)
+	p.Description = strings.TrimSpace(p.Description)
+	if len(p.Title) > maxTitleLen || !utf8.ValidString(p.Title) {
+		return errTitle
+	}
+	if len(p.Description) > maxDescriptionLen || !utf8.ValidString(p.Description) {
+		return errDescription
+	}
+	seen := make(map[string]bool)
+	var tags []string
+	for _, t := range p.Tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLen || !utf8.ValidString(t) ||
+			strings.IndexFunc(t, func(r rune) bool {
+				return unicode.IsSpace(r) || r == ',' || !unicode.IsPrint(r)
+			}) >= 0 {
+			return errTag
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	if len(tags) > maxTags {
+		return errTooManyTags
+	}
+	sort.Strings(tags)
+	p.Tags = tags
+	return nil
+}
+
+// splitTags splits a comma separated list of tags, as given in headers.
+func splitTags(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,104 @@
+package pimbin
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCleanInfo(t *testing.T) {
+	tooManyTags := make([]string, maxTags+1)
+	for i := range tooManyTags {
+		tooManyTags[i] = "t" + strconv.Itoa(i)
+	}
+	tests := []struct {
+		name string
+		in   Paste
+		want Paste
+		err  error
+	}{
+		{
+			name: "trimmed",
+			in:   Paste{Title: "  title ", Description: "\n desc \n"},
+			want: Paste{Title: "title", Description: "desc"},
+		},
+		{
+			name: "tags tidied",
+			in:   Paste{Tags: []string{"Go", " go ", "", "rust", "  "}},
+			want: Paste{Tags: []string{"go", "rust"}},
+		},
+		{
+			name: "duplicate tags don't count towards the limit",
+			in:   Paste{Tags: append(tooManyTags[:maxTags:maxTags], "t0", "T1")},
+			want: Paste{Tags: sortedCopy(tooManyTags[:maxTags])},
+		},
+		{name: "long title", in: Paste{Title: strings.Repeat("a", maxTitleLen+1)}, err: errTitle},
+		{name: "invalid title", in: Paste{Title: "\xff"}, err: errTitle},
+		{name: "long description", in: Paste{Description: strings.Repeat("a", maxDescriptionLen+1)}, err: errDescription},
+		{name: "tag with a space", in: Paste{Tags: []string{"two words"}}, err: errTag},
+		{name: "tag with a comma", in: Paste{Tags: []string{"a,b"}}, err: errTag},
+		{name: "tag with a control character", in: Paste{Tags: []string{"a\x00b"}}, err: errTag},
+		{name: "long tag", in: Paste{Tags: []string{strings.Repeat("a", maxTagLen+1)}}, err: errTag},
+		{name: "too many tags", in: Paste{Tags: tooManyTags}, err: errTooManyTags},
+	}
+	for _, tt := range tests {
+		p := tt.in
+		err := cleanInfo(&p)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, p, tt.want)
+		}
+	}
+}
+
+func sortedCopy(s []string) []string {
+	c := append([]string(nil), s...)
+	sort.Strings(c)
+	return c
+}
+
+func TestSplitTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a,b, c", []string{"a", "b", " c"}},
+	}
+	for _, tt := range tests {
+		if got := splitTags(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitTags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUploadTags(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	file := formField{"file", "a.txt", "hello\n"}
+
+	var fields []formField
+	for i := 0; i <= maxTags; i++ {
+		fields = append(fields, formField{"tag", "", "t" + strconv.Itoa(i)})
+	}
+	if w := upload(s, append(fields, file)...); w.Code != 400 {
+		t.Errorf("uploading with too many tags: got status %d, want 400", w.Code)
+	}
+	long := formField{"tag", "", strings.Repeat("a", maxDescriptionLen)}
+	if w := upload(s, long, file); w.Code != 400 {
+		t.Errorf("uploading with a long tag: got status %d, want 400", w.Code)
+	}
+
+	w := upload(s, formField{"title", "", "Title"}, formField{"tag", "", "B"},
+		formField{"tag", "", "a"}, file)
+	p := uploaded(t, s, w)
+	if p.Title != "Title" || !reflect.DeepEqual(p.Tags, []string{"a", "b"}) {
+		t.Errorf("got title %q and tags %q", p.Title, p.Tags)
+	}
+}
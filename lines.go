@@ -0,0 +1,90 @@
+package pimbin
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxRanges is the most line ranges that can be asked for at once.
+const maxRanges = 100
+
+var errBadRange = errors.New("invalid line range")
+
+// parseRanges parses a comma separated list of 1-based line numbers and
+// inclusive ranges of them, like "10-20,35".
+func parseRanges(s string) ([][2]int, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) > maxRanges {
+		return nil, errBadRange
+	}
+	ranges := make([][2]int, 0, len(parts))
+	for _, part := range parts {
+		var start, end int
+		var err error
+		if i := strings.Index(part, "-"); i >= 0 {
+			start, err = strconv.Atoi(part[:i])
+			if err == nil {
+				end, err = strconv.Atoi(part[i+1:])
+			}
+		} else {
+			start, err = strconv.Atoi(part)
+			end = start
+		}
+		if err != nil || start < 1 || end < 1 {
+			return nil, errBadRange
+		}
+		if start > end {
+			start, end = end, start
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges, nil
+}
+
+// parseHighlights parses hl query parameters, which are either line
+// ranges for every file or a file name and line ranges separated by a
+// colon. Invalid values are ignored.
+func parseHighlights(values []string) map[string][][2]int {
+	hl := make(map[string][][2]int)
+	for _, v := range values {
+		var name string
+		if i := strings.LastIndex(v, ":"); i >= 0 {
+			name, v = v[:i], v[i+1:]
+		}
+		if ranges, err := parseRanges(v); err == nil {
+			hl[name] = append(hl[name], ranges...)
+		}
+	}
+	return hl
+}
+
+// copyLines copies the lines of r that are in any of the ranges to w.
+func copyLines(w io.Writer, r io.Reader, ranges [][2]int) error {
+	br := bufio.NewReader(r)
+	last := 0
+	for _, rng := range ranges {
+		if rng[1] > last {
+			last = rng[1]
+		}
+	}
+	for n := 1; n <= last; n++ {
+		line, err := br.ReadString('\n')
+		for _, rng := range ranges {
+			if n >= rng[0] && n <= rng[1] {
+				if _, err := io.WriteString(w, line); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package pimbin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRanges(t *testing.T) {
+	tests := []struct {
+		in   string
+		want [][2]int
+		err  bool
+	}{
+		{in: "1", want: [][2]int{{1, 1}}},
+		{in: "10-20", want: [][2]int{{10, 20}}},
+		{in: "10-20,35", want: [][2]int{{10, 20}, {35, 35}}},
+		{in: "20-10", want: [][2]int{{10, 20}}},
+		{in: "", err: true},
+		{in: "0", err: true},
+		{in: "-5", err: true},
+		{in: "5-", err: true},
+		{in: "1,,2", err: true},
+		{in: "a-b", err: true},
+		{in: "1-2-3", err: true},
+		{in: strings.Repeat("1,", maxRanges) + "1", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRanges(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseRanges(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRanges(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRanges(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseHighlights(t *testing.T) {
+	got := parseHighlights([]string{"1-2", "main.go:5", "dir/a:b.txt:7,9", "x:bad", "3"})
+	want := map[string][][2]int{
+		"":            {{1, 2}, {3, 3}},
+		"main.go":     {{5, 5}},
+		"dir/a:b.txt": {{7, 7}, {9, 9}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCopyLines(t *testing.T) {
+	const text = "one\ntwo\nthree\nfour\nfive"
+	tests := []struct {
+		ranges [][2]int
+		want   string
+	}{
+		{[][2]int{{1, 1}}, "one\n"},
+		{[][2]int{{2, 3}}, "two\nthree\n"},
+		{[][2]int{{4, 4}, {1, 1}}, "one\nfour\n"},
+		{[][2]int{{1, 2}, {2, 3}}, "one\ntwo\nthree\n"},
+		{[][2]int{{4, 100}}, "four\nfive"},
+		{[][2]int{{10, 20}}, ""},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := copyLines(&b, strings.NewReader(text), tt.ranges); err != nil {
+			t.Errorf("copyLines(%v): %v", tt.ranges, err)
+			continue
+		}
+		if b.String() != tt.want {
+			t.Errorf("copyLines(%v) = %q, want %q", tt.ranges, b.String(), tt.want)
+		}
+	}
+}
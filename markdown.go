@@ -0,0 +1,102 @@
+package pimbin
+
+import (
+	"bytes"
+	"html/template"
+	"path"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	mdhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// isMarkdown reports whether a file should be rendered as Markdown.
+func isMarkdown(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// renderMarkdown renders GitHub flavored Markdown to HTML, with code
+// blocks highlighted like any other file. Raw HTML and links with
+// dangerous schemes like javascript: are left out.
+func (s *Server) renderMarkdown(src []byte, style *chroma.Style) (template.HTML, error) {
+	md := goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithParserOptions(parser.WithASTTransformers(
+			util.Prioritized(dangerousAutoLinks{}, 100))),
+		goldmark.WithRendererOptions(renderer.WithNodeRenderers(
+			util.Prioritized(&codeBlockRenderer{style: style}, 100))))
+	var b bytes.Buffer
+	if err := md.Convert(src, &b); err != nil {
+		return "", err
+	}
+	return template.HTML(`<div class="markdown">` + b.String() + `</div>`), nil
+}
+
+// dangerousAutoLinks turns autolinks with dangerous schemes into plain
+// text, since goldmark only leaves them out of ordinary links.
+type dangerousAutoLinks struct{}
+
+func (dangerousAutoLinks) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var links []*ast.AutoLink
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if l, ok := n.(*ast.AutoLink); ok && entering && mdhtml.IsDangerousURL(l.URL(source)) {
+			links = append(links, l)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, l := range links {
+		l.Parent().ReplaceChild(l.Parent(), l, ast.NewString(l.Label(source)))
+	}
+}
+
+// codeBlockRenderer renders fenced code blocks with chroma.
+type codeBlockRenderer struct {
+	style *chroma.Style
+}
+
+func (c *codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, c.renderFencedCodeBlock)
+}
+
+func (c *codeBlockRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.FencedCodeBlock)
+	var code strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		code.Write(seg.Value(source))
+	}
+	var lexer chroma.Lexer
+	if lang := n.Language(source); lang != nil {
+		lexer = lexers.Get(string(lang))
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, code.String())
+	if err != nil {
+		return ast.WalkStop, err
+	}
+	formatter := html.New(html.WithClasses(true))
+	if err := formatter.Format(w, c.style, iterator); err != nil {
+		return ast.WalkStop, err
+	}
+	return ast.WalkSkipChildren, nil
+}
@@ -0,0 +1,88 @@
+package pimbin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/chroma/styles"
+)
+
+func TestIsMarkdown(t *testing.T) {
+	for name, want := range map[string]bool{
+		"README.md":       true,
+		"docs/NOTES.MD":   true,
+		"a.markdown":      true,
+		"a.txt":           false,
+		"md":              false,
+		"README.md.orig":  false,
+		"dir.md/file.txt": false,
+	} {
+		if got := isMarkdown(name); got != want {
+			t.Errorf("isMarkdown(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	s := &Server{}
+	tests := []struct {
+		src     string
+		want    []string
+		notWant []string
+	}{
+		{
+			src:  "# Title\n\n*hi*\n",
+			want: []string{`<div class="markdown">`, "<h1>Title</h1>", "<em>hi</em>"},
+		},
+		{
+			src:     "a <script>alert(1)</script> b\n\n<script>\nalert(2)\n</script>\n",
+			want:    []string{"raw HTML omitted"},
+			notWant: []string{"<script"},
+		},
+		{
+			src:     `<iframe src="https://example.com/"></iframe>` + "\n",
+			want:    []string{"raw HTML omitted"},
+			notWant: []string{"<iframe"},
+		},
+		{
+			src:     "[click](javascript:alert(1)) [ok](https://example.com/)\n",
+			want:    []string{`<a href="https://example.com/">ok</a>`},
+			notWant: []string{"javascript:"},
+		},
+		{
+			src:     "<javascript:alert(1)> <https://example.com/>\n",
+			want:    []string{"<p>javascript:alert(1) ", `<a href="https://example.com/">`},
+			notWant: []string{`href="javascript:`},
+		},
+		{
+			src:     "```go\nfunc main() {}\n```\n",
+			want:    []string{`<pre class="chroma">`, `<span class="kd">func</span>`, `<span class="nf">main</span>`},
+			notWant: []string{"<code"},
+		},
+		{
+			src:  "```\n<b>plain</b>\n```\n",
+			want: []string{`<pre class="chroma">`, "&lt;b&gt;plain&lt;/b&gt;"},
+		},
+		{
+			src:  "| a | b |\n|---|---|\n| 1 | 2 |\n\n~~gone~~\n",
+			want: []string{"<table>", "<td>1</td>", "<del>gone</del>"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := s.renderMarkdown([]byte(tt.src), styles.Fallback)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(string(got), want) {
+				t.Errorf("%q: got %s, want it to contain %s", tt.src, got, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(string(got), notWant) {
+				t.Errorf("%q: got %s, which contains %s", tt.src, got, notWant)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package pimbin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var errBadImage = errors.New("malformed image")
+
+// stripMetadata copies the JPEG or PNG image in r to w, leaving out any
+// EXIF, XMP, IPTC, comments and other text metadata. Image data, color
+// profiles and, for JPEGs, the EXIF orientation are left as they are.
+func stripMetadata(w io.Writer, r io.Reader, ctype string) error {
+	switch ctype {
+	case "image/jpeg":
+		return stripJPEG(w, r)
+	case "image/png":
+		return stripPNG(w, r)
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+func stripJPEG(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return errBadImage
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+	for {
+		b, err := br.ReadByte()
+		if err != nil || b != 0xff {
+			return errBadImage
+		}
+		marker, err := br.ReadByte()
+		// Any number of 0xff bytes can come before the marker.
+		for err == nil && marker == 0xff {
+			marker, err = br.ReadByte()
+		}
+		if err != nil {
+			return errBadImage
+		}
+		switch {
+		case marker == 0xd9, marker == 0xda:
+			// Once the image data starts, everything after is copied
+			// untouched, since parsing it would mean decoding it.
+			if _, err := w.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, br)
+			return err
+		case marker == 0x01, marker >= 0xd0 && marker <= 0xd7:
+			// These markers have no segment.
+			if _, err := w.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			return errBadImage
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return errBadImage
+		}
+		switch {
+		case marker == 0xe1:
+			// EXIF or XMP. Browsers rotate images according to their
+			// EXIF orientation, so that gets to stay.
+			o := exifOrientation(segment)
+			if o < 2 || o > 8 {
+				continue
+			}
+			segment = minimalExif(o)
+		case marker == 0xe2:
+			if !bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")) {
+				continue
+			}
+		case marker == 0xfe, marker >= 0xe3 && marker <= 0xef && marker != 0xee:
+			// Comments and application segments other than JFIF,
+			// ICC profiles and Adobe's color transform flags.
+			continue
+		}
+		length = uint16(len(segment) + 2)
+		if _, err := w.Write([]byte{0xff, marker, byte(length >> 8), byte(length)}); err != nil {
+			return err
+		}
+		if _, err := w.Write(segment); err != nil {
+			return err
+		}
+	}
+}
+
+// exifOrientation returns the orientation tag from the first IFD of an
+// EXIF APP1 segment, or 0 if there isn't one.
+func exifOrientation(app1 []byte) int {
+	if !bytes.HasPrefix(app1, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := app1[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// Orientation is a SHORT, tag 0x0112.
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// minimalExif returns an EXIF APP1 segment containing nothing but the
+// given orientation.
+func minimalExif(orientation int) []byte {
+	return []byte{
+		'E', 'x', 'i', 'f', 0, 0,
+		// Big endian TIFF header, with the first IFD straight after it.
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		// One entry: orientation, a single SHORT.
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		// No next IFD.
+		0, 0, 0, 0,
+	}
+}
+
+// pngMetadataChunks are the PNG chunks that stripPNG leaves out.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(w io.Writer, r io.Reader) error {
+	var sig [8]byte
+	if _, err := io.ReadFull(r, sig[:]); err != nil ||
+		string(sig[:]) != "\x89PNG\r\n\x1a\n" {
+		return errBadImage
+	}
+	if _, err := w.Write(sig[:]); err != nil {
+		return err
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return errBadImage
+		}
+		// The chunk's data is followed by a 4 byte CRC.
+		length := int64(binary.BigEndian.Uint32(hdr[:4])) + 4
+		typ := string(hdr[4:])
+		dst := w
+		if pngMetadataChunks[typ] {
+			dst = ioutil.Discard
+		} else if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, r, length); err == io.EOF {
+			return errBadImage
+		} else if err != nil {
+			return err
+		}
+		if typ == "IEND" {
+			// Anything after the end of the image is dropped too.
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		}
+	}
+}
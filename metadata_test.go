@@ -0,0 +1,238 @@
+package pimbin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erebid/pimbin/config"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	return img
+}
+
+func jpegSegment(marker byte, data string) string {
+	n := len(data) + 2
+	return string([]byte{0xff, marker, byte(n >> 8), byte(n)}) + data
+}
+
+// exifEntry is an entry of a TIFF IFD, with a value that fits in it.
+type exifEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    uint32
+}
+
+// exifSegment returns the contents of an EXIF APP1 segment with a camera
+// make and, if it's not 0, an orientation.
+func exifSegment(order binary.ByteOrder, orientation int) string {
+	var b bytes.Buffer
+	b.WriteString("Exif\x00\x00")
+	if order == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+	binary.Write(&b, order, uint16(42))
+	binary.Write(&b, order, uint32(8))
+	entries := []exifEntry{
+		// Make, an ASCII string short enough to fit in the entry.
+		{0x010f, 2, 4, order.Uint32([]byte("Cam\x00"))},
+	}
+	if orientation != 0 {
+		var value [4]byte
+		order.PutUint16(value[:], uint16(orientation))
+		entries = append(entries, exifEntry{0x0112, 3, 1, order.Uint32(value[:])})
+	}
+	binary.Write(&b, order, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(&b, order, e)
+	}
+	binary.Write(&b, order, uint32(0))
+	return b.String()
+}
+
+func TestExifOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{"little endian", exifSegment(binary.LittleEndian, 6), 6},
+		{"big endian", exifSegment(binary.BigEndian, 8), 8},
+		{"minimal", string(minimalExif(3)), 3},
+		{"no orientation", exifSegment(binary.BigEndian, 0), 0},
+		{"XMP", "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>", 0},
+		{"bad byte order", strings.Replace(exifSegment(binary.BigEndian, 6), "MM", "XX", 1), 0},
+		{"truncated", exifSegment(binary.BigEndian, 6)[:20], 0},
+		{"empty", "", 0},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation([]byte(tt.in)); got != tt.want {
+			t.Errorf("%s: got orientation %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	soi, rest := b.String()[:2], b.String()[2:]
+	icc := jpegSegment(0xe2, "ICC_PROFILE\x00\x01\x01profile")
+	adobe := jpegSegment(0xee, "Adobe\x00\x64\x00\x00\x00\x00\x01")
+	metadata := jpegSegment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>") +
+		jpegSegment(0xe2, "MPF\x00not a profile") +
+		jpegSegment(0xed, "Photoshop 3.0\x00IPTC") +
+		jpegSegment(0xfe, "a comment")
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "orientation kept",
+			in:   soi + jpegSegment(0xe1, exifSegment(binary.LittleEndian, 6)) + metadata + icc + adobe + rest,
+			want: soi + jpegSegment(0xe1, string(minimalExif(6))) + icc + adobe + rest,
+		},
+		{
+			name: "default orientation dropped",
+			in:   soi + jpegSegment(0xe1, exifSegment(binary.BigEndian, 1)) + metadata + rest,
+			want: soi + rest,
+		},
+		{
+			name: "fill bytes before a marker",
+			in:   soi + "\xff\xff" + jpegSegment(0xfe, "a comment") + rest,
+			want: soi + rest,
+		},
+		{
+			name: "nothing to strip",
+			in:   b.String(),
+			want: b.String(),
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := stripJPEG(&out, strings.NewReader(tt.in)); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, out.String(), tt.want)
+			continue
+		}
+		if _, err := jpeg.Decode(&out); err != nil {
+			t.Errorf("%s: the stripped image doesn't decode: %v", tt.name, err)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"\x89PNG\r\n\x1a\n",
+		soi,
+		soi + "\x00\xe1",
+		soi + "\xff\xe1\x00\x01",
+		soi + "\xff\xe1\x00\x10short",
+	} {
+		if err := stripJPEG(ioutil.Discard, strings.NewReader(in)); err != errBadImage {
+			t.Errorf("stripJPEG(%q): got error %v, want %v", in, err, errBadImage)
+		}
+	}
+}
+
+func pngChunk(typ, data string) string {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.WriteString(typ)
+	b.WriteString(data)
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE([]byte(typ+data)))
+	return b.String()
+}
+
+func TestStripPNG(t *testing.T) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	// The signature and the IHDR chunk, which has to come first.
+	head, rest := b.String()[:33], b.String()[33:]
+	gamma := pngChunk("gAMA", "\x00\x00\xb1\x8f")
+
+	in := head + pngChunk("tEXt", "Author\x00someone") + gamma +
+		pngChunk("iTXt", "Comment\x00\x00\x00\x00\x00hi") +
+		pngChunk("zTXt", "Software\x00\x00x") + pngChunk("tIME", "\x07\xea\x01\x02\x03\x04\x05") +
+		pngChunk("eXIf", exifSegment(binary.BigEndian, 6)[6:]) + rest + "trailing data"
+	want := head + gamma + rest
+	var out bytes.Buffer
+	if err := stripPNG(&out, strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+	if _, err := png.Decode(&out); err != nil {
+		t.Errorf("the stripped image doesn't decode: %v", err)
+	}
+
+	for _, in := range []string{
+		"",
+		"\xff\xd8\xff",
+		head[:8],
+		head[:20],
+		head + pngChunk("tEXt", "a\x00b")[:10],
+	} {
+		if err := stripPNG(ioutil.Discard, strings.NewReader(in)); err != errBadImage {
+			t.Errorf("stripPNG(%q): got error %v, want %v", in, err, errBadImage)
+		}
+	}
+}
+
+func TestUploadStripMetadata(t *testing.T) {
+	s, cleanup := newTestServer(t, func(cfg *config.Server) { cfg.StripMetadata = true })
+	defer cleanup()
+	var b bytes.Buffer
+	if err := png.Encode(&b, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	plain := b.String()
+	tagged := plain[:33] + pngChunk("tEXt", "Author\x00someone") + plain[33:]
+
+	stored := func(p *Paste) string {
+		b, err := ioutil.ReadFile(filepath.Join(s.Config.UploadsDir, p.Files[0].Hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	p := uploaded(t, s, upload(s, formField{"file", "a.png", tagged}))
+	if stored(p) != plain {
+		t.Error("the uploaded image's metadata wasn't stripped")
+	}
+	p = uploaded(t, s, upload(s, formField{"keep-metadata", "", "true"},
+		formField{"file", "a.png", tagged}))
+	if stored(p) != tagged {
+		t.Error("the image was stripped despite keep-metadata")
+	}
+
+	if w := upload(s, formField{"file", "a.png", plain[:20]}); w.Code != 400 {
+		t.Errorf("uploading a broken image: got status %d, want 400", w.Code)
+	}
+	w := upload(s, formField{"file", "a.png", tagged}, formField{"keep-metadata", "", "true"})
+	if w.Code != 400 {
+		t.Errorf("keep-metadata after a file: got status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,10 @@
+package pimbin
+
+import "github.com/erebid/pimbin/paste"
+
+// Paste and File are defined in the paste package, so that clients can
+// use them without importing the server.
+type (
+	Paste = paste.Paste
+	File  = paste.File
+)
@@ -0,0 +1,39 @@
+// Package paste has the types that describe pastes. They're shared by the
+// server and its client, and kept apart so that the client doesn't depend
+// on the server.
+package paste
+
+import "time"
+
+// Paste contains a paste's data. A paste with a URL is a short link,
+// and has no files.
+type Paste struct {
+	ID          string   `json:"id"`
+	Owner       string   `json:"-"`
+	Files       []File   `json:"files"`
+	URL         string   `json:"url,omitempty"`
+	Clicks      int64    `json:"clicks"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Created is when the paste was made. It's zero for pastes from
+	// before it was recorded that haven't been backfilled.
+	Created time.Time `json:"created"`
+}
+
+// File describes a paste's file. Lang is the name of the language the
+// file was uploaded as, if one was given.
+//
+// The rest is recorded when the file is uploaded. ContentType is the
+// type that the file is served as, and DeclaredType the one that the
+// client gave, if any.
+type File struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+	Lang string `json:"lang,omitempty"`
+
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type,omitempty"`
+	DeclaredType string    `json:"declared_type,omitempty"`
+	Created      time.Time `json:"created"`
+}
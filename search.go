@@ -0,0 +1,196 @@
+package pimbin
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/erebid/pimbin/config"
+)
+
+// indexPaste adds the text files of a new paste to the search index.
+// Failing to isn't reason enough to fail the upload, so errors are only
+// logged.
+func (s *Server) indexPaste(p Paste) {
+	for _, f := range p.Files {
+		_, err := indexFile(s.Config, s.db, p.ID, f)
+		if err == ErrNoSearch {
+			return
+		} else if err != nil {
+			log.Println("index:", err)
+		}
+	}
+}
+
+// indexFile adds a file to the search index if it's text, reporting
+// whether it was.
+func indexFile(cfg config.Server, db *DB, paste string, f File) (bool, error) {
+	r, err := os.Open(filepath.Join(cfg.UploadsDir, f.Hash))
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	ctype := f.ContentType
+	if ctype == "" {
+		if ctype, err = detectType(f.Name, r); err != nil {
+			return false, err
+		}
+	}
+	if !strings.HasPrefix(ctype, "text/") {
+		return false, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, cfg.SearchMaxSize+1))
+	if err != nil {
+		return false, err
+	}
+	// Huge files are probably logs or data that would bloat the index,
+	// and are still found by name.
+	if int64(len(b)) > cfg.SearchMaxSize || !utf8.Valid(b) {
+		b = nil
+	}
+	return true, db.IndexFile(paste, f, searchLang(f), string(b))
+}
+
+// searchLang returns the language that a file is found under by search:
+// the one it was uploaded as, or else the one that its name suggests.
+func searchLang(f File) string {
+	if f.Lang != "" {
+		return f.Lang
+	}
+	if lexer := lexers.Match(f.Name); lexer != nil {
+		return lexer.Config().Name
+	}
+	return ""
+}
+
+// searchResult is a search result as the API returns it.
+type searchResult struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Lang    string    `json:"lang,omitempty"`
+	Created time.Time `json:"created"`
+	// Snippet is HTML, with the matching words in mark elements.
+	Snippet string `json:"snippet"`
+}
+
+// handleSearch searches the files of the user's pastes. Admins search
+// everyone's, unless they pick an owner.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	u, ok := r.Context().Value(userKey).(*User)
+	if !ok {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	params := r.URL.Query()
+	q := SearchQuery{
+		Terms: strings.Fields(params.Get("q")),
+		Owner: params.Get("owner"),
+		Name:  params.Get("name"),
+		Limit: 50,
+	}
+	if !s.isAdmin(u.Name) {
+		if q.Owner != "" && q.Owner != u.Name {
+			http.Error(w, "forbidden", 403)
+			return
+		}
+		q.Owner = u.Name
+	}
+	if lang := params.Get("lang"); lang != "" {
+		lexer := lexers.Get(lang)
+		if lexer == nil {
+			http.Error(w, "Unknown language", 400)
+			return
+		}
+		q.Lang = lexer.Config().Name
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > 200 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+		q.Limit = n
+	}
+	for _, d := range []struct {
+		param string
+		t     *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := params.Get(d.param); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				http.Error(w, "Invalid date, use YYYY-MM-DD", 400)
+				return
+			}
+			*d.t = t
+		}
+	}
+	if !q.Until.IsZero() {
+		// Include all of the last day.
+		q.Until = q.Until.AddDate(0, 0, 1)
+	}
+
+	found, err := s.db.Search(q)
+	if err == ErrNoSearch {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	results := make([]searchResult, 0, len(found))
+	for _, f := range found {
+		created := f.Created
+		if created.IsZero() {
+			created, _ = pasteTime(f.Paste)
+		}
+		results = append(results, searchResult{
+			ID:      f.Paste,
+			URL:     s.Config.BaseURL + f.Paste,
+			Name:    f.File.Name,
+			Hash:    f.File.Hash,
+			Lang:    f.File.Lang,
+			Created: created,
+			Snippet: snippetHTML(f.Snippet),
+		})
+	}
+	writeJSON(w, results)
+}
+
+func (s *Server) isAdmin(name string) bool {
+	for _, a := range s.Config.Admins {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// snippetHTML escapes a search snippet and turns its markers into mark
+// elements.
+func snippetHTML(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.Replace(snippet, SnippetStart, "<mark>", -1)
+	return strings.Replace(snippet, SnippetEnd, "</mark>", -1)
+}
+
+// pasteTime returns when a paste was made, which is what its ID encodes.
+func pasteTime(id string) (time.Time, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(b) != 4 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.LittleEndian.Uint32(b)), 0).UTC(), true
+}
@@ -0,0 +1,263 @@
+package pimbin
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erebid/pimbin/config"
+)
+
+func TestSnippetHTML(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"say " + SnippetStart + "hello" + SnippetEnd + "!", "say <mark>hello</mark>!"},
+		{SnippetStart + "a" + SnippetEnd + " & " + SnippetStart + "b" + SnippetEnd,
+			"<mark>a</mark> &amp; <mark>b</mark>"},
+		{"<script>" + SnippetStart + "x" + SnippetEnd + "</script>",
+			"&lt;script&gt;<mark>x</mark>&lt;/script&gt;"},
+	}
+	for _, tt := range tests {
+		if got := snippetHTML(tt.in); got != tt.want {
+			t.Errorf("snippetHTML(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPasteTime(t *testing.T) {
+	when := time.Date(2025, 1, 5, 1, 26, 24, 0, time.UTC)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(when.Unix()))
+	tests := []struct {
+		id   string
+		want time.Time
+		ok   bool
+	}{
+		{"AAAAAA", time.Unix(0, 0).UTC(), true},
+		{base64.RawURLEncoding.EncodeToString(b[:]), when, true},
+		{"short", time.Time{}, false},
+		{"AAAAAAAA", time.Time{}, false},
+		{"AAAA/A", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := pasteTime(tt.id)
+		if !got.Equal(tt.want) || ok != tt.ok {
+			t.Errorf("pasteTime(%q) = %v, %t, want %v, %t", tt.id, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// putPaste stores and indexes a paste made at the given time, with files
+// given as pairs of names and contents. A name can be followed by a colon
+// and the language that the file was uploaded as.
+func putPaste(t *testing.T, s *Server, id, owner string, created time.Time, files ...string) {
+	p := Paste{ID: id, Owner: owner}
+	for i := 0; i < len(files); i += 2 {
+		hash, err := s.downloadFile(strings.NewReader(files[i+1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := File{Hash: hash, Name: files[i]}
+		if n := strings.Index(f.Name, ":"); n >= 0 {
+			f.Name, f.Lang = f.Name[:n], f.Name[n+1:]
+		}
+		p.Files = append(p.Files, f)
+	}
+	if err := s.describePaste(&p); err != nil {
+		t.Fatal(err)
+	}
+	p.Created = created
+	if err := s.db.PutPaste(p); err != nil {
+		t.Fatal(err)
+	}
+	s.indexPaste(p)
+}
+
+func TestSearch(t *testing.T) {
+	s, cleanup := newTestServer(t, func(cfg *config.Server) {
+		cfg.NoAuth = false
+		cfg.Admins = []string{"alice"}
+		cfg.SearchMaxSize = 100
+	})
+	defer cleanup()
+	if !s.db.fts {
+		t.Skip("SQLite was built without FTS5")
+	}
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+	day := func(date string) time.Time {
+		d, _ := time.Parse("2006-01-02", date)
+		return d.Add(12 * time.Hour)
+	}
+	putPaste(t, s, "p1", "alice", day("2024-01-10"),
+		"main.go", "package main\n\nfunc hello() {}\n",
+		"build:Bash", "echo hello\n")
+	putPaste(t, s, "p2", "bob", day("2024-02-20"),
+		"notes.txt", "hello world, <say> hello again\n",
+		"image.png", "\x89PNG\r\n\x1a\nhello")
+	putPaste(t, s, "p3", "bob", day("2024-03-05"),
+		"big.txt", strings.Repeat("hello ", 20))
+
+	search := func(token, query string) ([]searchResult, int) {
+		req := httptest.NewRequest("GET", "/api/v1/search?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		var results []searchResult
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || results == nil {
+				t.Errorf("%s: got body %q", query, w.Body)
+			}
+		}
+		return results, w.Code
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		query  string
+		want   []string
+		status int
+	}{
+		{"own pastes", bob, "q=hello", []string{"p2"}, 200},
+		{"admin", alice, "q=hello", []string{"p1", "p1", "p2"}, 200},
+		{"admin picking an owner", alice, "q=hello&owner=bob", []string{"p2"}, 200},
+		{"someone else's", bob, "q=hello&owner=alice", nil, 403},
+		{"language from the name", alice, "q=hello&lang=go", []string{"p1"}, 200},
+		{"language uploaded as", alice, "q=echo&lang=bash", []string{"p1"}, 200},
+		{"another language", alice, "q=hello&lang=python", []string{}, 200},
+		{"unknown language", alice, "lang=nope", nil, 400},
+		{"name", alice, "name=notes", []string{"p2"}, 200},
+		{"binary files aren't indexed", alice, "name=image", []string{}, 200},
+		{"large files are found by name", alice, "q=big", []string{"p3"}, 200},
+		{"terms in quotes", alice, `q="hello`, []string{"p1", "p1", "p2"}, 200},
+		{"dates", alice, "since=2024-02-01&until=2024-02-20", []string{"p2"}, 200},
+		{"since", alice, "since=2024-02-21", []string{"p3"}, 200},
+		{"invalid date", alice, "since=yesterday", nil, 400},
+		{"limit", alice, "limit=1", []string{"p3"}, 200},
+		{"invalid limit", alice, "limit=0", nil, 400},
+		{"no token", "", "q=hello", nil, 401},
+	}
+	for _, tt := range tests {
+		results, status := search(tt.token, tt.query)
+		if status != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.status)
+			continue
+		}
+		if status != 200 {
+			continue
+		}
+		got := []string{}
+		for _, r := range results {
+			got = append(got, r.ID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got pastes %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	results, _ := search(alice, "q=hello&owner=alice")
+	langs := make(map[string]string)
+	for _, r := range results {
+		langs[r.Name] = r.Lang
+	}
+	if !reflect.DeepEqual(langs, map[string]string{"main.go": "Go", "build": "Bash"}) {
+		t.Errorf("got languages %v", langs)
+	}
+
+	results, _ = search(bob, "q=hello")
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	r := results[0]
+	if r.URL != s.Config.BaseURL+"p2" || r.Name != "notes.txt" || !r.Created.Equal(day("2024-02-20")) {
+		t.Errorf("got result %+v", r)
+	}
+	if !strings.Contains(r.Snippet, "<mark>hello</mark>") || !strings.Contains(r.Snippet, "&lt;say&gt;") {
+		t.Errorf("got snippet %q", r.Snippet)
+	}
+}
+
+func TestSearchUnavailable(t *testing.T) {
+	s, cleanup := newTestServer(t, func(cfg *config.Server) { cfg.NoAuth = false })
+	defer cleanup()
+	if s.db.fts {
+		t.Skip("SQLite was built with FTS5")
+	}
+	req := httptest.NewRequest("GET", "/api/v1/search?q=hello", nil)
+	req.Header.Set("Authorization", addUser(t, s, "alice"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != 501 {
+		t.Errorf("got status %d, want 501", w.Code)
+	}
+	if _, _, err := Backfill(s.Config, s.db); err != nil {
+		t.Errorf("backfilling without search: %v", err)
+	}
+}
+
+func TestBackfillIndex(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	if !s.db.fts {
+		t.Skip("SQLite was built without FTS5")
+	}
+	hash, err := s.downloadFile(strings.NewReader("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A paste from before search, which was never indexed.
+	p := Paste{ID: "old", Files: []File{
+		{Hash: hash, Name: "a.txt"},
+		{Hash: "missing", Name: "b.txt"},
+	}}
+	if err := s.db.PutPaste(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, indexed, err := Backfill(s.Config, s.db); err != nil || indexed != 1 {
+		t.Fatalf("indexed %d files, error %v, want 1", indexed, err)
+	}
+	found, err := s.db.Search(SearchQuery{Terms: []string{"hello"}, Limit: 10})
+	if err != nil || len(found) != 1 || found[0].Paste != "old" {
+		t.Errorf("got results %+v, error %v", found, err)
+	}
+	if _, indexed, err := Backfill(s.Config, s.db); err != nil || indexed != 0 {
+		t.Errorf("backfilling again indexed %d files, error %v", indexed, err)
+	}
+}
+
+func TestSearchIndexUpgrade(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	if !s.db.fts {
+		t.Skip("SQLite was built without FTS5")
+	}
+	// An index from before files' languages were stored.
+	_, err := s.db.db.Exec(`DROP TABLE search;
+		CREATE VIRTUAL TABLE search USING fts5(paste UNINDEXED, hash UNINDEXED, name, content);
+		INSERT INTO search VALUES ('old', 'hash', 'a.txt', 'hello');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.createSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := s.db.db.QueryRow("SELECT count(*) FROM search").Scan(&n); err != nil || n != 0 {
+		t.Errorf("the old index has %d rows, error %v", n, err)
+	}
+	if err := s.db.IndexFile("new", File{Hash: "hash", Name: "a.go"}, "Go", "hello"); err != nil {
+		t.Errorf("indexing after rebuilding: %v", err)
+	}
+}
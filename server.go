@@ -6,18 +6,27 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
+	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/lexers"
 	"github.com/erebid/pimbin/config"
 	"github.com/go-chi/chi"
 )
@@ -26,22 +35,78 @@ import (
 type Server struct {
 	Config config.Server
 
-	router *chi.Mux
-	db     *DB
-	ticker *time.Ticker
-	users  map[string]*user
+	router     *chi.Mux
+	siteRouter *chi.Mux
+	db         *DB
+	ticker     *time.Ticker
+	users      map[string]*user
+	thumbLock  sync.Mutex
+	templates  map[string]*template.Template
+
+	// blobHolds counts the requests holding each blob, from storing it
+	// until they're done with it. See releaseBlobs.
+	blobLock  sync.Mutex
+	blobHolds map[string]int
+
+	// tusLocks holds the IDs of the uploads that a request is working
+	// on, so that two PATCHes can't write to the same upload at once.
+	tusLocks sync.Map
+	// stop is closed by Close to end the server's background work.
+	stop chan struct{}
+
+	renderCache *renderCache
+	started     time.Time
+	fetcher     *http.Client
+
+	style    *chroma.Style
+	css      string
+	cssCache sync.Map
 }
 
-// NewServer returns a new Server that uses the given database.
-func NewServer(db *DB) (*Server, error) {
+// NewServer returns a new Server that uses the given configuration and
+// database.
+func NewServer(cfg config.Server, db *DB) (*Server, error) {
 	t := time.NewTicker(time.Second)
 	r := chi.NewRouter()
 	s := &Server{
+		Config: cfg,
 		db:     db,
 		router: r,
 		ticker: t,
 		users:  make(map[string]*user),
+
+		blobHolds: make(map[string]int),
+		stop:      make(chan struct{}),
 	}
+	s.style = lookupStyle(cfg.Style)
+	if s.style == nil {
+		return nil, fmt.Errorf("unknown style %q", cfg.Style)
+	}
+	var dark *chroma.Style
+	if cfg.DarkStyle != "" {
+		dark = lookupStyle(cfg.DarkStyle)
+		if dark == nil {
+			return nil, fmt.Errorf("unknown style %q", cfg.DarkStyle)
+		}
+	}
+	s.css = styleCSS(s.style, dark)
+	var err error
+	s.siteRouter, err = s.siteRoutes()
+	if err != nil {
+		return nil, err
+	}
+	s.templates, err = s.loadTemplates()
+	if err != nil {
+		return nil, err
+	}
+	s.started = time.Now()
+	s.fetcher = newFetchClient(cfg)
+	s.renderCache, err = newRenderCache(cfg.RenderCacheSize,
+		cfg.RenderCacheDir, cfg.RenderCacheDiskSize)
+	if err != nil {
+		return nil, err
+	}
+
 	users, err := s.db.Users()
 	if err != nil {
 		return nil, err
@@ -50,27 +115,70 @@ func NewServer(db *DB) (*Server, error) {
 		s.users[u.Name] = &user{srv: s, User: u}
 	}
 	r.Get("/style.css", s.handleCSS)
+	r.Get("/api/v1/languages", s.handleLanguages)
+	r.With(s.ownerCheck).Get("/api/v1/stats", s.handleStats)
+	r.With(s.ownerCheck).Get("/api/v1/pastes", s.handleListPastes)
+	r.With(s.ownerCheck).Get("/api/v1/search", s.handleSearch)
+	r.Get("/api/v1/pastes/{id}", s.handleGetPasteJSON)
+	r.With(s.ownerCheck).Get("/api/v1/uploaders/sharex.sxcu", s.handleShareX)
+	r.With(s.ownerCheck).Get("/api/v1/uploaders/flameshot.sh", s.handleFlameshot)
 	r.Route("/{id}", func(r chi.Router) {
 		r.Get("/", s.handleGetPaste)
+		r.Get("/archive.{format}", s.handleGetArchive)
 		r.With(s.ownerCheck).Delete("/", s.handleDeletePaste)
+		r.With(s.ownerCheck).Patch("/", s.handleEditPaste)
+		r.With(s.ownerCheck).Put("/", s.handleRawUpload)
+		r.Get("/delete/{key}", s.handleDeleteWithKey)
+		r.Post("/delete/{key}", s.handleDeleteWithKey)
+		r.Get("/site", s.handleSiteRedirect)
+		r.Get("/site/*", s.handleSiteRedirect)
 	})
 	r.Route("/raw/{hash}", func(r chi.Router) {
 		r.Get("/", s.handleGetFile)
-		r.Get("/{name}", s.handleGetFile)
+		r.Get("/*", s.handleGetFile)
+	})
+	r.Get("/thumb/{hash}", s.handleGetThumbnail)
+	r.Route("/tus", func(r chi.Router) {
+		r.Use(s.tusHeaders)
+		r.Options("/", s.handleTusOptions)
+		r.With(s.ownerCheck).Post("/", s.handleTusCreate)
+		r.With(s.ownerCheck).Head("/{upload}", s.handleTusHead)
+		r.With(s.ownerCheck).Patch("/{upload}", s.handleTusPatch)
+		r.With(s.ownerCheck).Delete("/{upload}", s.handleTusDelete)
 	})
+	r.Get("/", s.handleUploadPage)
 	r.With(s.ownerCheck).Post("/", s.handleUpload)
+	r.With(s.ownerCheck).Put("/", s.handleRawUpload)
+
+	go s.cleanTusUploads()
 	return s, nil
 }
 
+// Close stops the server's background work. It doesn't close the
+// database, and the server can't make any more pastes afterwards.
+func (s *Server) Close() {
+	s.ticker.Stop()
+	close(s.stop)
+}
+
 // To make golint happy, and so there won't be any collisions
 type contextKey int
 const userKey contextKey = iota
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if site := s.siteHost(); site != "" && r.Host == site {
+		s.siteRouter.ServeHTTP(w, r)
+		return
+	}
 	s.router.ServeHTTP(w, r)
 }
 
 func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ctype != "multipart/form-data" {
+		s.handleRawUpload(w, r)
+		return
+	}
 	var username string
 	if u, ok := r.Context().Value(userKey).(*User); ok {
 		username = u.Name
@@ -84,16 +192,33 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// Every blob this stores is let go of at the end, and the ones that
+	// didn't make it into the paste are removed.
+	var stored []string
+	var kept []File
+	defer func() { s.releaseBlobs(stored, kept) }()
 	files := make(map[int]string)
 	names := make(map[int]string)
 	types := make(map[int]string)
+	declared := make(map[int]string)
+	extract := make(map[int]bool)
+	langs := make(map[int]string)
 	var index []int
+	var link string
+	strip := s.Config.StripMetadata
+	// Fetched files aren't part of the request's body, but together
+	// they're held to the same limit.
+	fetchBudget := s.Config.MaxBodySize
 	for {
 		p, err := form.NextPart()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			if bodyTooLarge(err) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
 			http.Error(w, err.Error(),
 				http.StatusInternalServerError)
 			return
@@ -117,14 +242,30 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "Bad request", 400)
 				return
 			}
-			buf := bufio.NewReader(p)
-			sniff, err := buf.Peek(512)
-			contentType := http.DetectContentType(sniff)
-			if !s.allowType(contentType) {
+			var name string
+			if n := partFileName(p); n != "" {
+				var ok bool
+				if name, ok = cleanName(n); !ok {
+					http.Error(w, "Invalid file name", 400)
+					return
+				}
+			}
+			file, contentType, err := s.storeFile(p, strip)
+			if err == nil {
+				stored = append(stored, file)
+			}
+			if err == errTypeNotAllowed {
 				http.Error(w, "Content type not allowed", 418)
 				return
 			}
-			file, err := s.downloadFile(buf)
+			if err == errBadImage {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if bodyTooLarge(err) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil {
 				http.Error(w, err.Error(),
 					http.StatusInternalServerError)
@@ -133,18 +274,57 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 			index = append(index, i)
 			files[i] = file
 			types[i] = contentType
-			if name := p.FileName(); name != "" {
+			declared[i] = declaredType(p.Header.Get("Content-Type"))
+			if name != "" {
+				names[i] = name
+			}
+		case "fetch":
+			if _, ok := files[i]; ok {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(p, 4096))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			file, contentType, name, err := s.fetchFile(r.Context(),
+				strings.TrimSpace(string(b)), strip, &fetchBudget)
+			switch err {
+			case nil:
+				stored = append(stored, file)
+			case errTypeNotAllowed:
+				http.Error(w, "Content type not allowed", 418)
+				return
+			case errFetchURL, errFetchBlocked, errBadImage:
+				http.Error(w, err.Error(), 400)
+				return
+			case errFetchTooLarge:
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			index = append(index, i)
+			files[i] = file
+			types[i] = contentType
+			if _, ok := names[i]; !ok && name != "" {
 				names[i] = name
 			}
 		case "name", "n":
-			reader := &io.LimitedReader{R: p, N: 129}
+			reader := &io.LimitedReader{R: p, N: maxNameLen + 1}
 			b := new(strings.Builder)
 			_, err := io.Copy(b, reader)
 			if err != nil || reader.N == 0 {
 				http.Error(w, "Bad request", 400)
 				return
 			}
-			name := b.String()
+			name, ok := cleanName(b.String())
+			if !ok {
+				http.Error(w, "Invalid file name", 400)
+				return
+			}
 			for _, n := range names {
 				if n == name {
 					http.Error(w, "Bad request", 400)
@@ -152,14 +332,122 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			names[i] = name
+		case "url", "u":
+			if link != "" {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(p, 4096))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			u, err := url.Parse(strings.TrimSpace(string(b)))
+			if err != nil || u.Host == "" ||
+				(u.Scheme != "http" && u.Scheme != "https") {
+				http.Error(w, "Invalid URL", 400)
+				return
+			}
+			link = u.String()
+		case "lang", "l":
+			b, err := ioutil.ReadAll(io.LimitReader(p, 64))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			lexer := lexers.Get(strings.TrimSpace(string(b)))
+			if lexer == nil {
+				http.Error(w, "Unknown language", 400)
+				return
+			}
+			langs[i] = lexer.Config().Name
+		case "keep-metadata":
+			// This has to come before any files it applies to, since
+			// they're processed as they arrive.
+			if len(index) > 0 {
+				http.Error(w, "keep-metadata must come before any files", 400)
+				return
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(p, 8))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			keep, err := strconv.ParseBool(string(b))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			strip = s.Config.StripMetadata && !keep
+		case "title", "description":
+			b, err := ioutil.ReadAll(io.LimitReader(p, maxDescriptionLen+1))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			if n[0] == "title" {
+				paste.Title = string(b)
+			} else {
+				paste.Description = string(b)
+			}
+		case "tag":
+			if len(paste.Tags) >= maxTags {
+				http.Error(w, errTooManyTags.Error(), 400)
+				return
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(p, maxTagLen+1))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			paste.Tags = append(paste.Tags, string(b))
+		case "extract", "x":
+			b, err := ioutil.ReadAll(io.LimitReader(p, 8))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
+			extract[i], err = strconv.ParseBool(string(b))
+			if err != nil {
+				http.Error(w, "Bad request", 400)
+				return
+			}
 		default:
 			http.Error(w, "Bad request", 400)
 			return
 		}
 	}
+	if link != "" && len(index) > 0 {
+		http.Error(w, "Bad request", 400)
+		return
+	}
+	if err := cleanInfo(&paste); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 	sort.Ints(index)
-	paste.ID = s.id()
+	paste.URL = link
+	var unpacked []File
 	for _, i := range index {
+		if extract[i] {
+			extracted, err := s.extractArchive(files[i], strip)
+			stored = append(stored, fileHashes(extracted)...)
+			switch err {
+			case nil:
+			case errTypeNotAllowed:
+				http.Error(w, "Content type not allowed", 418)
+				return
+			case errArchiveFormat, errArchiveLimit, errArchivePath, errArchiveEmpty, errBadImage:
+				http.Error(w, err.Error(), 400)
+				return
+			default:
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			paste.Files = append(paste.Files, extracted...)
+			unpacked = append(unpacked, extracted...)
+			continue
+		}
 		name, ok := names[i]
 		if !ok {
 			if len(index) == 1 {
@@ -172,17 +460,172 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		file := File{
-			Hash: files[i],
-			Name: name,
+			Hash:         files[i],
+			Name:         name,
+			Lang:         langs[i],
+			DeclaredType: declared[i],
 		}
 		paste.Files = append(paste.Files, file)
 	}
+	// Files unpacked from archives can't share a name with any other file.
+	seen := make(map[string]int)
+	for _, f := range paste.Files {
+		seen[f.Name]++
+	}
+	for _, f := range unpacked {
+		if seen[f.Name] > 1 {
+			http.Error(w, "Duplicate file name: "+f.Name, 400)
+			return
+		}
+	}
+	paste.ID = s.id()
+	if err := s.describePaste(&paste); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = s.db.PutPaste(paste)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	kept = paste.Files
+	s.indexPaste(paste)
+	s.writeUploadResponse(w, r, paste)
+}
+
+// handleRawUpload makes a paste of a single file sent as the request
+// body, as with curl -T. The file's name is the last part of the path,
+// or for a POST, the Filename header. The options that would be form
+// fields in a normal upload are given as the Lang, Keep-Metadata,
+// Extract, Title and Description headers, and Tags, which is a comma
+// separated list.
+func (s *Server) handleRawUpload(w http.ResponseWriter, r *http.Request) {
+	var username string
+	if u, ok := r.Context().Value(userKey).(*User); ok {
+		username = u.Name
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.Config.MaxBodySize)
+	name := r.Header.Get("Filename")
+	if r.Method == "PUT" {
+		// chi matches against the escaped path, if there is one.
+		var err error
+		name, err = url.PathUnescape(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid file name", 400)
+			return
+		}
+	}
+	if name != "" {
+		var ok bool
+		name, ok = cleanName(name)
+		if !ok {
+			http.Error(w, "Invalid file name", 400)
+			return
+		}
+	}
+	var lang string
+	if l := r.Header.Get("Lang"); l != "" {
+		lexer := lexers.Get(strings.TrimSpace(l))
+		if lexer == nil {
+			http.Error(w, "Unknown language", 400)
+			return
+		}
+		lang = lexer.Config().Name
+	}
+	strip := s.Config.StripMetadata
+	if k := r.Header.Get("Keep-Metadata"); k != "" {
+		keep, err := strconv.ParseBool(k)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+		strip = s.Config.StripMetadata && !keep
+	}
+	info := Paste{
+		Title:       r.Header.Get("Title"),
+		Description: r.Header.Get("Description"),
+		Tags:        splitTags(r.Header.Get("Tags")),
+	}
+	if err := cleanInfo(&info); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var extract bool
+	if x := r.Header.Get("Extract"); x != "" {
+		var err error
+		extract, err = strconv.ParseBool(x)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+	}
+
+	hash, ctype, err := s.storeFile(r.Body, strip)
+	switch {
+	case err == nil:
+	case err == errTypeNotAllowed:
+		http.Error(w, "Content type not allowed", 418)
+		return
+	case err == errBadImage:
+		http.Error(w, err.Error(), 400)
+		return
+	case bodyTooLarge(err):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stored := []string{hash}
+	var kept []File
+	defer func() { s.releaseBlobs(stored, kept) }()
+	paste := Paste{
+		Owner:       username,
+		Title:       info.Title,
+		Description: info.Description,
+		Tags:        info.Tags,
+	}
+	if extract {
+		paste.Files, err = s.extractArchive(hash, strip)
+		stored = append(stored, fileHashes(paste.Files)...)
+		switch err {
+		case nil:
+		case errTypeNotAllowed:
+			http.Error(w, "Content type not allowed", 418)
+			return
+		case errArchiveFormat, errArchiveLimit, errArchivePath, errArchiveEmpty, errBadImage:
+			http.Error(w, err.Error(), 400)
+			return
+		default:
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	} else {
+		if name == "" {
+			if exts, err := mime.ExtensionsByType(ctype); err == nil {
+				name = exts[0]
+			}
+		}
+		paste.Files = []File{{
+			Hash:         hash,
+			Name:         name,
+			Lang:         lang,
+			DeclaredType: declaredType(r.Header.Get("Content-Type")),
+		}}
+	}
+	paste.ID = s.id()
+	if err := s.describePaste(&paste); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 	err = s.db.PutPaste(paste)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	fmt.Fprintf(w, "%s%s\n", s.Config.BaseURL, paste.ID)
+	kept = paste.Files
+	s.indexPaste(paste)
+	s.writeUploadResponse(w, r, paste)
 }
 
 func (s *Server) handleDeletePaste(w http.ResponseWriter, r *http.Request) {
@@ -195,8 +638,12 @@ func (s *Server) handleDeletePaste(w http.ResponseWriter, r *http.Request) {
 	}
 	id := chi.URLParam(r, "id")
 	p, err := s.db.Paste(id)
-	if err != nil || p.Owner != username {
-		http.Error(w, err.Error(), 401)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if p.Owner != username {
+		http.Error(w, "unauthorized", 401)
 		return
 	}
 	err = s.db.DeletePaste(id)
@@ -205,29 +652,152 @@ func (s *Server) handleDeletePaste(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleEditPaste changes a paste's title, description or tags, given as
+// form fields like in an upload. Fields that aren't given are left as
+// they are, and giving any tag fields replaces all of the tags.
+func (s *Server) handleEditPaste(w http.ResponseWriter, r *http.Request) {
+	var username string
+	if u, ok := r.Context().Value(userKey).(*User); ok {
+		username = u.Name
+	} else {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	p, err := s.db.Paste(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if p.Owner != username {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, "Bad request", 400)
+		return
+	}
+	if v, ok := r.PostForm["title"]; ok {
+		p.Title = v[0]
+	}
+	if v, ok := r.PostForm["description"]; ok {
+		p.Description = v[0]
+	}
+	if v, ok := r.PostForm["tag"]; ok {
+		p.Tags = v
+	}
+	if err := cleanInfo(p); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := s.db.UpdatePaste(*p); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if p.Files == nil {
+		p.Files = []File{}
+	}
+	writeJSON(w, p)
+}
+
 func (s *Server) handleGetPaste(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	p, err := s.db.Paste(id)
 	if err != nil {
-		http.NotFound(w, r)
+		s.renderError(w, r, http.StatusNotFound, "There's no paste with that ID.")
+		return
+	}
+	if p.URL != "" {
+		if s.Config.CountClicks {
+			s.db.CountClick(id)
+		}
+		http.Redirect(w, r, p.URL, http.StatusFound)
 		return
 	}
 	if len(p.Files) == 1 {
-		f, ctype, err := s.getPasteFile(p.Files[0])
-		if err != nil {
-			http.NotFound(w, r)
-			return
+		ctype := servedType(p.Files[0].ContentType)
+		if ctype == "" {
+			f, t, err := s.getPasteFile(p.Files[0])
+			if err != nil {
+				s.renderError(w, r, http.StatusNotFound, "The paste's file is missing.")
+				return
+			}
+			f.Close()
+			ctype = t
 		}
 		if ctype != "text/plain" {
-			http.Redirect(w, r,
-				s.Config.BaseURL+"raw/"+p.Files[0].Hash+"/"+p.Files[0].Name, 301)
+			http.Redirect(w, r, s.Config.BaseURL+rawPath(p.Files[0]), 301)
 			return
 		}
-		f.Close()
 	}
-	s.renderPaste(w, p)
+	s.renderPaste(w, r, p)
+}
+
+// partFileName returns the filename p was sent with. Unlike p.FileName,
+// it keeps the directories in the name.
+func partFileName(p *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
 }
 
+// mediaTypes are the content types of audio and video files, which
+// systems often lack mime.types entries for and which browsers need
+// to know to play them.
+var mediaTypes = map[string]string{
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".weba": "audio/webm",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp4":  "video/mp4",
+	".ogv":  "video/ogg",
+	".webm": "video/webm",
+}
+
+var errTypeNotAllowed = errors.New("content type not allowed")
+
+// storeFile checks the content type of r against the filter and saves it
+// with downloadFile, returning its hash and detected content type. If
+// strip is set, metadata is removed from JPEG and PNG images first.
+func (s *Server) storeFile(r io.Reader, strip bool) (hash, ctype string, err error) {
+	buf := bufio.NewReader(r)
+	sniff, _ := buf.Peek(512)
+	ctype = http.DetectContentType(sniff)
+	if !s.allowType(ctype) {
+		return "", ctype, errTypeNotAllowed
+	}
+	if strip && (ctype == "image/jpeg" || ctype == "image/png") {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(stripMetadata(pw, buf, ctype))
+		}()
+		hash, err = s.downloadFile(pr)
+		pr.Close()
+		return hash, ctype, err
+	}
+	hash, err = s.downloadFile(buf)
+	return hash, ctype, err
+}
+
+// bodyTooLarge reports whether err is from reading more of a request's
+// body than http.MaxBytesReader allows. The error has no type of its own
+// to check for in older versions of Go.
+func bodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// downloadFile saves r as a blob named after its hash. The request that
+// called it holds the blob until it calls releaseBlobs.
 func (s *Server) downloadFile(r io.Reader) (string, error) {
 	err := os.MkdirAll(s.Config.UploadsDir, 0750)
 	if err != nil {
@@ -242,18 +812,55 @@ func (s *Server) downloadFile(r io.Reader) (string, error) {
 	tee := io.TeeReader(r, h)
 	_, err = io.Copy(f, tee)
 	if err != nil {
+		os.Remove(f.Name())
 		return "", err
 	}
 	hash := base64.URLEncoding.WithPadding(
 		base64.NoPadding).EncodeToString(h.Sum(nil))
+	// The blob is held as soon as it's there, so that releaseBlobs can't
+	// remove it in between.
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
 	err = os.Rename(f.Name(),
 		filepath.Join(s.Config.UploadsDir, hash))
 	if err != nil {
 		return "", err
 	}
+	s.blobHolds[hash]++
 	return hash, nil
 }
 
+// releaseBlobs lets go of the blobs that a request stored, once its paste
+// is in the database or it has failed. Blobs are shared by every file
+// with the same contents, so one is only removed if it isn't one of the
+// kept files, in any paste, or held by another request.
+func (s *Server) releaseBlobs(hashes []string, kept []File) {
+	keep := make(map[string]bool)
+	for _, f := range kept {
+		keep[f.Hash] = true
+	}
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+	for _, hash := range hashes {
+		s.blobHolds[hash]--
+		if s.blobHolds[hash] > 0 {
+			continue
+		}
+		delete(s.blobHolds, hash)
+		if keep[hash] {
+			continue
+		}
+		used, err := s.db.BlobUsed(hash)
+		if err != nil {
+			log.Println("remove blob:", err)
+			continue
+		}
+		if !used {
+			os.Remove(filepath.Join(s.Config.UploadsDir, hash))
+		}
+	}
+}
+
 func (s *Server) id() string {
 	<-s.ticker.C
 	now := time.Now().Unix()
@@ -278,40 +885,161 @@ func (s *Server) handleCSS(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, s.Config.CSSPath)
 		return
 	}
-	reader := strings.NewReader(defaultCSS)
+	css := s.css
+	if style := lookupStyle(r.URL.Query().Get("style")); style != nil {
+		// There aren't many styles, so it's fine to keep them all.
+		cached, ok := s.cssCache.Load(style.Name)
+		if !ok {
+			cached, _ = s.cssCache.LoadOrStore(style.Name, styleCSS(style, nil))
+		}
+		css = cached.(string)
+	}
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	reader := strings.NewReader(css)
 	http.ServeContent(w, r, "style.css", time.Time{}, reader)
 }
 
 func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
 	hash := chi.URLParam(r, "hash")
-	name := chi.URLParam(r, "name")
-	f, ctype, err := s.getPasteFile(File{Hash: hash, Name: name})
-	defer f.Close()
+	name := chi.URLParam(r, "*")
+	if !validHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	// chi matches against the escaped path, if there is one.
+	unescaped, err := url.PathUnescape(name)
+	if err != nil {
+		unescaped = name
+	}
+	file, err := s.db.File(hash, unescaped)
+	if err != nil {
+		// The name in the URL is only a hint, so any name will do.
+		file = &File{Hash: hash, Name: unescaped}
+	}
+	f, ctype, err := s.getPasteFile(*file)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	modified := file.Created
+	if modified.IsZero() {
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		modified = info.ModTime()
+	}
+	if lines := r.URL.Query().Get("lines"); lines != "" {
+		ranges, err := parseRanges(lines)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		// The ETag is the whole blob's, so it doesn't belong here.
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		copyLines(w, f, ranges)
+		return
+	}
+	// ServeContent handles range requests, which browsers need to seek
+	// through audio and video.
+	setImmutable(w, hash)
+	if download, _ := strconv.ParseBool(r.URL.Query().Get("download")); download {
+		dlname := path.Base(unescaped)
+		if name == "" {
+			dlname = hash
+		}
+		w.Header().Set("Content-Disposition",
+			contentDisposition("attachment", dlname))
 	}
 	w.Header().Set("Content-Type", ctype)
-	http.ServeContent(w, r, name, time.Time{}, f)
+	http.ServeContent(w, r, name, modified, f)
+}
+
+// setImmutable sets the headers for a response that never changes, and
+// so can be cached forever. tag is what identifies its content, which for
+// a blob is its hash. ServeContent takes care of conditional requests
+// against the ETag.
+func setImmutable(w http.ResponseWriter, tag string) {
+	w.Header().Set("ETag", `"`+tag+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+// contentDisposition returns a Content-Disposition header value with the
+// given file name. Since not every client understands RFC 5987 encoded
+// names, the name is also given in ASCII, with anything that isn't safe
+// in a quoted string replaced.
+func contentDisposition(disposition, name string) string {
+	var ascii, encoded strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			ascii.WriteByte('_')
+		} else {
+			ascii.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(name) {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`,
+		disposition, ascii.String(), encoded.String())
+}
+
+// etagMatch reports whether an If-None-Match header matches etag.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) getPasteFile(file File) (*os.File, string, error) {
+	f, ctype, err := s.openFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, servedType(ctype), nil
+}
+
+// servedType returns the type that a file of the given type is served
+// as in pastes. Text is always plain, so that it's shown rather than run.
+func servedType(ctype string) string {
+	if strings.HasPrefix(ctype, "text/") {
+		return "text/plain"
+	}
+	return ctype
+}
+
+// openFile opens a file's blob, returning it with the file's content
+// type. Files uploaded before types were stored have theirs worked out
+// again.
+func (s *Server) openFile(file File) (*os.File, string, error) {
 	f, err := os.Open(filepath.Join(s.Config.UploadsDir, file.Hash))
 	if err != nil {
 		return nil, "", err
 	}
-	ctype := mime.TypeByExtension(filepath.Ext(file.Name))
+	ctype := file.ContentType
 	if ctype == "" {
-		var buf [512]byte
-		n, _ := io.ReadFull(f, buf[:])
-		ctype = http.DetectContentType(buf[:n])
-		_, err := f.Seek(0, io.SeekStart)
+		ctype, err = detectType(file.Name, f)
 		if err != nil {
+			f.Close()
 			return nil, "", err
 		}
 	}
-	if strings.HasPrefix(ctype, "text/") {
-		ctype = "text/plain"
-	}
 	return f, ctype, nil
 }
 
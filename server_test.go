@@ -0,0 +1,318 @@
+package pimbin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/erebid/pimbin/config"
+)
+
+// newTestServer returns a server with its database and uploads in a
+// temporary directory, and a function that removes them. configure, if
+// it's not nil, can change the configuration first.
+func newTestServer(t *testing.T, configure func(*config.Server)) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "pimbin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Defaults()
+	cfg.UploadsDir = filepath.Join(dir, "uploads")
+	cfg.DBPath = filepath.Join(dir, "pimbin.db")
+	cfg.NoAuth = true
+	if configure != nil {
+		configure(cfg)
+	}
+	db, err := OpenSQLiteDB(cfg.DBPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s, err := NewServer(*cfg, db)
+	if err != nil {
+		db.db.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		db.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// addUser adds a user to the server and returns their token.
+func addUser(t *testing.T, s *Server, name string) string {
+	// Nobody logs in as them, so any password hash will do.
+	u := User{Name: name, Password: "x"}
+	if err := s.db.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.db.RefreshToken(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Token = token
+	s.users[name] = &user{srv: s, User: u}
+	return token
+}
+
+// blobs returns the names of the blobs in the server's uploads directory.
+func blobs(t *testing.T, s *Server) map[string]bool {
+	infos, err := ioutil.ReadDir(s.Config.UploadsDir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, info := range infos {
+		if !info.IsDir() {
+			names[info.Name()] = true
+		}
+	}
+	return names
+}
+
+// formField is a field of an upload form. It's a file if filename isn't
+// empty.
+type formField struct {
+	name, filename, value string
+}
+
+// upload posts a multipart form to the server.
+func upload(s *Server, fields ...formField) *httptest.ResponseRecorder {
+	var b bytes.Buffer
+	form := multipart.NewWriter(&b)
+	for _, f := range fields {
+		if f.filename != "" {
+			w, _ := form.CreateFormFile(f.name, f.filename)
+			w.Write([]byte(f.value))
+		} else {
+			form.WriteField(f.name, f.value)
+		}
+	}
+	form.Close()
+	req := httptest.NewRequest("POST", "/", &b)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+// uploaded returns the paste made by an upload, failing if there isn't
+// one.
+func uploaded(t *testing.T, s *Server, w *httptest.ResponseRecorder) *Paste {
+	if w.Code != 200 {
+		t.Fatalf("upload failed with status %d: %s", w.Code, w.Body)
+	}
+	id := strings.TrimPrefix(strings.TrimSpace(w.Body.String()), s.Config.BaseURL)
+	p, err := s.db.Paste(id)
+	if err != nil {
+		t.Fatalf("getting uploaded paste %q: %v", id, err)
+	}
+	return p
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.txt", `attachment; filename="a.txt"; filename*=UTF-8''a.txt`},
+		{"a b.txt", `attachment; filename="a b.txt"; filename*=UTF-8''a%20b.txt`},
+		{`say "hi"\.txt`, `attachment; filename="say _hi__.txt"; filename*=UTF-8''say%20%22hi%22%5C.txt`},
+		{"héllo.txt", `attachment; filename="h_llo.txt"; filename*=UTF-8''h%C3%A9llo.txt`},
+		{"a\r\nb", `attachment; filename="a__b"; filename*=UTF-8''a%0D%0Ab`},
+		{"a;b=c", `attachment; filename="a;b=c"; filename*=UTF-8''a%3Bb%3Dc`},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition("attachment", tt.name); got != tt.want {
+			t.Errorf("contentDisposition(%q) =\n%s, want\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	p := uploaded(t, s, upload(s,
+		formField{"file:1", "we#ird?.txt", "hello\n"},
+		formField{"file:2", "b.txt", "world\n"}))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/"+p.ID, nil))
+	link := `href="` + s.Config.BaseURL + "raw/" + p.Files[0].Hash + `/we%23ird%3f.txt?download=1"`
+	if !strings.Contains(strings.ToLower(w.Body.String()), strings.ToLower(link)) {
+		t.Errorf("paste page doesn't link to %s", link)
+	}
+
+	for query, download := range map[string]bool{
+		"":                false,
+		"?download=1":     true,
+		"?download=true":  true,
+		"?download=0":     false,
+		"?download=false": false,
+		"?download=maybe": false,
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/raw/"+p.Files[0].Hash+"/we%23ird%3F.txt"+query, nil))
+		if w.Code != 200 || w.Body.String() != "hello\n" {
+			t.Errorf("%s: got status %d and body %q", query, w.Code, w.Body)
+		}
+		got := w.Header().Get("Content-Disposition")
+		if download && !strings.Contains(got, `filename="we#ird?.txt"`) {
+			t.Errorf("%s: got Content-Disposition %q, want an attachment named we#ird?.txt", query, got)
+		} else if !download && got != "" {
+			t.Errorf("%s: got Content-Disposition %q, want none", query, got)
+		}
+	}
+}
+
+// rawUpload sends a file to the server as a request's body, with the
+// headers in pairs of names and values.
+func rawUpload(s *Server, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestRawUpload(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	archive := string(makeZip(t, []archiveEntry{{"a.txt", "first\n"}, {"dir/b.txt", "second\n"}}))
+
+	tests := []struct {
+		desc    string
+		method  string
+		path    string
+		body    string
+		headers []string
+		want    Paste
+	}{
+		{
+			desc:   "PUT with a name",
+			method: "PUT", path: "/a.txt", body: "hello\n",
+			want: Paste{Files: []File{{Name: "a.txt"}}},
+		},
+		{
+			desc:   "PUT with an escaped slash",
+			method: "PUT", path: "/dir%2Fa.txt", body: "hello\n",
+			want: Paste{Files: []File{{Name: "dir/a.txt"}}},
+		},
+		{
+			desc:   "POST with the name in the header",
+			method: "POST", path: "/", body: "package main\n",
+			headers: []string{"Filename", "main.go", "Content-Type", "text/x-go"},
+			want:    Paste{Files: []File{{Name: "main.go", DeclaredType: "text/x-go"}}},
+		},
+		{
+			desc:   "POST of a form",
+			method: "POST", path: "/", body: "a=b",
+			headers: []string{"Filename", "form", "Content-Type", "application/x-www-form-urlencoded"},
+			want:    Paste{Files: []File{{Name: "form", DeclaredType: "application/x-www-form-urlencoded"}}},
+		},
+		{
+			desc:   "information",
+			method: "PUT", path: "/a.txt", body: "hello\n",
+			headers: []string{"Lang", " python ", "Title", "Title", "Description", "About it", "Tags", "B,a"},
+			want: Paste{
+				Files:       []File{{Name: "a.txt", Lang: "Python"}},
+				Title:       "Title",
+				Description: "About it",
+				Tags:        []string{"a", "b"},
+			},
+		},
+		{
+			desc:   "extracted",
+			method: "PUT", path: "/a.zip", body: archive,
+			headers: []string{"Extract", "1", "Lang", "Go"},
+			want:    Paste{Files: []File{{Name: "a.txt"}, {Name: "dir/b.txt"}}},
+		},
+		{
+			desc:   "not extracted",
+			method: "PUT", path: "/a.zip", body: archive,
+			headers: []string{"Extract", "false"},
+			want:    Paste{Files: []File{{Name: "a.zip"}}},
+		},
+	}
+	for _, tt := range tests {
+		p := uploaded(t, s, rawUpload(s, tt.method, tt.path, tt.body, tt.headers...))
+		if p.Title != tt.want.Title || p.Description != tt.want.Description ||
+			!reflect.DeepEqual(p.Tags, tt.want.Tags) || len(p.Files) != len(tt.want.Files) {
+			t.Errorf("%s: got %+v", tt.desc, *p)
+			continue
+		}
+		for i, f := range p.Files {
+			want := tt.want.Files[i]
+			if f.Name != want.Name || f.Lang != want.Lang || f.DeclaredType != want.DeclaredType {
+				t.Errorf("%s: got file %+v, want %+v", tt.desc, f, want)
+			}
+		}
+		if tt.headers == nil && p.Files[0].Hash != "" {
+			b, err := ioutil.ReadFile(filepath.Join(s.Config.UploadsDir, p.Files[0].Hash))
+			if err != nil || string(b) != tt.body {
+				t.Errorf("%s: the file contains %q, error %v", tt.desc, b, err)
+			}
+		}
+	}
+
+	// Without a name, one is made up from the type of the contents.
+	p := uploaded(t, s, rawUpload(s, "POST", "/", "\x89PNG\r\n\x1a\n"))
+	if len(p.Files) != 1 || p.Files[0].Name != ".png" {
+		t.Errorf("without a name: got files %+v", p.Files)
+	}
+
+	var tags []string
+	for i := 0; i <= maxTags; i++ {
+		tags = append(tags, "t"+strconv.Itoa(i))
+	}
+	before := blobs(t, s)
+	if w := rawUpload(s, "POST", "/", "hello\n", "Filename", "/etc/passwd"); w.Code != 400 {
+		t.Errorf("POST with a bad name: got status %d, want 400", w.Code)
+	}
+	for _, tt := range []struct {
+		desc    string
+		path    string
+		body    string
+		headers []string
+	}{
+		{"name outside the paste", "/..%2Fa.txt", "hello\n", nil},
+		{"unknown language", "/a.txt", "hello\n", []string{"Lang", "nonsense"}},
+		{"too many tags", "/a.txt", "hello\n", []string{"Tags", strings.Join(tags, ",")}},
+		{"bad Extract", "/a.zip", archive, []string{"Extract", "maybe"}},
+		{"bad Keep-Metadata", "/a.txt", "hello\n", []string{"Keep-Metadata", "maybe"}},
+		{"extracting something else", "/a.txt", "hello\n", []string{"Extract", "true"}},
+	} {
+		if w := rawUpload(s, "PUT", tt.path, tt.body, tt.headers...); w.Code != 400 {
+			t.Errorf("%s: got status %d, want 400", tt.desc, w.Code)
+		}
+	}
+	if after := blobs(t, s); !reflect.DeepEqual(after, before) {
+		t.Errorf("rejected uploads changed the blobs from %v to %v", before, after)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	s, cleanup := newTestServer(t, func(cfg *config.Server) { cfg.MaxBodySize = 1024 })
+	defer cleanup()
+	big := strings.Repeat("x", 2048)
+	if w := upload(s, formField{"file", "a.txt", big}); w.Code != 413 {
+		t.Errorf("form upload: got status %d, want 413", w.Code)
+	}
+	if w := rawUpload(s, "PUT", "/a.txt", big); w.Code != 413 {
+		t.Errorf("raw upload: got status %d, want 413", w.Code)
+	}
+	if left := blobs(t, s); len(left) != 0 {
+		t.Errorf("uploads that were too large left blobs behind: %v", left)
+	}
+}
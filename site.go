@@ -0,0 +1,113 @@
+package pimbin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// siteHost returns the host that pastes are served from as websites, or
+// an empty string if site mode is disabled.
+func (s *Server) siteHost() string {
+	if s.Config.SiteURL == "" {
+		return ""
+	}
+	u, err := url.Parse(s.Config.SiteURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// siteRoutes returns the router for the site origin. Pastes' sites are
+// served under the site URL's path, so that the origin can be proxied to
+// pimbin from a subdirectory.
+func (s *Server) siteRoutes() (*chi.Mux, error) {
+	r := chi.NewRouter()
+	r.Get("/{id}/site", s.handleSiteRedirect)
+	r.Get("/{id}/site/*", s.handleSite)
+	if s.Config.SiteURL == "" {
+		return r, nil
+	}
+	u, err := url.Parse(s.Config.SiteURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid site-url %q", s.Config.SiteURL)
+	}
+	prefix := strings.TrimSuffix(u.Path, "/")
+	if prefix == "" {
+		return r, nil
+	}
+	root := chi.NewRouter()
+	root.Mount(prefix, r)
+	return root, nil
+}
+
+// siteURL returns the address of a paste's site.
+func (s *Server) siteURL(id string) string {
+	return strings.TrimSuffix(s.Config.SiteURL, "/") + "/" + id + "/site/"
+}
+
+// handleSiteRedirect sends requests for a paste's site to the site origin,
+// making sure that the path ends with a slash so relative links resolve.
+func (s *Server) handleSiteRedirect(w http.ResponseWriter, r *http.Request) {
+	if s.siteHost() == "" {
+		http.NotFound(w, r)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	target := s.siteURL(id)
+	// Without a wildcard of its own, the route's * is the one that the
+	// paste's routes are mounted with, which is "site".
+	if strings.HasSuffix(chi.RouteContext(r.Context()).RoutePattern(), "/*") {
+		target += chi.URLParam(r, "*")
+	}
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func (s *Server) handleSite(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	p, err := s.db.Paste(id)
+	if err != nil || siteFile(p, "index.html") == nil {
+		http.NotFound(w, r)
+		return
+	}
+	name := chi.URLParam(r, "*")
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	file := siteFile(p, name)
+	if file == nil {
+		if siteFile(p, name+"/index.html") != nil {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	f, ctype, err := s.openFile(*file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, time.Time{}, f)
+}
+
+// siteFile returns the file in p with the given name, if it has one.
+func siteFile(p *Paste, name string) *File {
+	for i := range p.Files {
+		if p.Files[i].Name == name {
+			return &p.Files[i]
+		}
+	}
+	return nil
+}
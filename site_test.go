@@ -0,0 +1,73 @@
+package pimbin
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erebid/pimbin/config"
+)
+
+func TestSite(t *testing.T) {
+	for _, siteURL := range []string{
+		"http://sites.example/",
+		"http://sites.example/pimbin/",
+		"http://sites.example/pimbin",
+	} {
+		t.Run(siteURL, func(t *testing.T) {
+			s, cleanup := newTestServer(t, func(cfg *config.Server) { cfg.SiteURL = siteURL })
+			defer cleanup()
+			p := Paste{ID: "home"}
+			for _, f := range []archiveEntry{{"index.html", "<p>home</p>"}, {"docs/index.html", "<p>docs</p>"}} {
+				hash, err := s.downloadFile(strings.NewReader(f.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.Files = append(p.Files, File{Hash: hash, Name: f.name})
+			}
+			if err := s.db.PutPaste(p); err != nil {
+				t.Fatal(err)
+			}
+			base := strings.TrimSuffix(siteURL, "/") + "/home/site/"
+
+			for path, want := range map[string]string{
+				"/home/site?a=b":      base + "?a=b",
+				"/home/site/docs/":    base + "docs/",
+				"/home/site/a/b.html": base + "a/b.html",
+			} {
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+				if w.Code != 302 || w.Header().Get("Location") != want {
+					t.Errorf("%s: got status %d and Location %q, want %q",
+						path, w.Code, w.Header().Get("Location"), want)
+				}
+			}
+			w := httptest.NewRecorder()
+
+			for path, want := range map[string]string{"": "<p>home</p>", "docs/": "<p>docs</p>"} {
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, httptest.NewRequest("GET", base+path, nil))
+				if w.Code != 200 || w.Body.String() != want {
+					t.Errorf("%s: got status %d and body %q", base+path, w.Code, w.Body)
+				}
+			}
+			s.ServeHTTP(w, httptest.NewRequest("GET", base+"docs", nil))
+			if w.Code != 301 {
+				t.Errorf("directory without a slash: got status %d, want 301", w.Code)
+			}
+			w = httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", base+"missing.html", nil))
+			if w.Code != 404 {
+				t.Errorf("missing file: got status %d, want 404", w.Code)
+			}
+		})
+	}
+}
+
+func TestSiteURLInvalid(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.SiteURL = "/just/a/path/"
+	if _, err := NewServer(*cfg, nil); err == nil {
+		t.Error("a site-url without a host was accepted")
+	}
+}
@@ -0,0 +1,466 @@
+package pimbin
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/alecthomas/chroma"
+)
+
+// Pages are rendered from the "layout" template, which is parsed
+// together with the template of the page being rendered. Each page
+// defines "content", and may also define "title" and "head" to go in
+// the document's head. Any of them can be replaced by putting a file
+// named after the template, like paste.html, in the directory set by
+// the templates option.
+//
+// Besides the usual functions, templates can use base, which is
+// path.Base, isMarkdown, which reports whether a file name is that of a
+// Markdown file, rawPath, which returns the escaped path of a File's raw
+// contents relative to the base URL, and size, which formats a number of
+// bytes. The paste page can also use renderFile, which is given the
+// page's data and a File, and renders the File to HTML as the viewer
+// asked. The data passed to each page is described below, and won't
+// change in incompatible ways.
+
+// pageView is the data that every page gets, which is all that the
+// layout template can rely on.
+type pageView struct {
+	// SiteName is the name of the site from the configuration.
+	SiteName string
+	// BaseURL is the base URL from the configuration, with a trailing
+	// slash.
+	BaseURL string
+	// Style is the name of the highlighting style that the viewer has
+	// picked, or empty if they haven't, which should be passed on to
+	// style.css in the style query parameter.
+	Style string
+}
+
+// pasteView is the data that the "paste" page gets.
+type pasteView struct {
+	pageView
+	// Paste is the paste being shown.
+	Paste Paste
+	// Tree is Paste's files arranged into directories.
+	Tree *fileTree
+	// SiteURL is the address of the paste as a website, if it can be
+	// viewed as one.
+	SiteURL string
+	// Source is set when files like Markdown should be shown as source
+	// code instead of rendered.
+	Source bool
+
+	// opts is how the viewer asked for files to be rendered, which
+	// renderFile needs.
+	opts renderOptions
+}
+
+// uploadView is the data that the "upload" page gets.
+type uploadView struct {
+	pageView
+	// NoAuth is set when uploading doesn't need a token.
+	NoAuth bool
+	// MaxBodySize is the largest upload allowed, in bytes.
+	MaxBodySize int64
+}
+
+// errorView is the data that the "error" page gets.
+type errorView struct {
+	pageView
+	// Status is the HTTP status code of the error.
+	Status int
+	// StatusText is the text for Status, like "Not Found".
+	StatusText string
+	// Message describes what went wrong.
+	Message string
+}
+
+// deleteView is the data that the "delete" page gets.
+type deleteView struct {
+	pageView
+	// Paste is the paste being deleted.
+	Paste Paste
+	// Deleted is set once the paste has been deleted.
+	Deleted bool
+}
+
+// pages are the templates that can be rendered, other than the layout.
+var pages = []string{"paste", "upload", "error", "delete"}
+
+var defaultTemplates = map[string]string{
+	"layout": layoutTemplate,
+	"paste":  pasteTemplate,
+	"upload": uploadTemplate,
+	"error":  errorTemplate,
+	"delete": deleteTemplate,
+}
+
+var templateFuncs = template.FuncMap{
+	"base":       path.Base,
+	"isMarkdown": isMarkdown,
+	"rawPath":    rawPath,
+	"size":       formatSize,
+}
+
+// loadTemplates parses the templates for every page, using the ones in
+// the templates directory where there are any.
+func (s *Server) loadTemplates() (map[string]*template.Template, error) {
+	layout, err := s.templateSource("layout")
+	if err != nil {
+		return nil, err
+	}
+	funcs := template.FuncMap{
+		"renderFile": func(view pasteView, f File) template.HTML {
+			return s.renderFile(f, view.opts)
+		},
+	}
+	for name, f := range templateFuncs {
+		funcs[name] = f
+	}
+	base, err := template.New("layout").Funcs(funcs).Parse(layout)
+	if err != nil {
+		return nil, err
+	}
+	templates := make(map[string]*template.Template)
+	for _, name := range pages {
+		src, err := s.templateSource(name)
+		if err != nil {
+			return nil, err
+		}
+		t, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.New(name).Parse(src); err != nil {
+			return nil, err
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+func (s *Server) templateSource(name string) (string, error) {
+	if s.Config.Templates != "" {
+		b, err := ioutil.ReadFile(filepath.Join(s.Config.Templates, name+".html"))
+		if err == nil {
+			return string(b), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return defaultTemplates[name], nil
+}
+
+// renderPage renders a page with the given data.
+func (s *Server) renderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	templates := s.templates
+	if s.Config.Dev {
+		// Load them every time, so that changes show up straight away.
+		var err error
+		templates, err = s.loadTemplates()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	var b bytes.Buffer
+	if err := templates[name].ExecuteTemplate(&b, "layout", data); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	b.WriteTo(w)
+}
+
+// pageView returns the fields that every page has, given the style that
+// the viewer picked, if any, from viewerStyle.
+func (s *Server) pageView(style *chroma.Style) pageView {
+	view := pageView{
+		SiteName: s.Config.SiteName,
+		BaseURL:  s.Config.BaseURL,
+	}
+	if style != nil {
+		view.Style = style.Name
+	}
+	return view
+}
+
+// renderError renders the error page. It's for requests that come from
+// browsers, other ones should get a plain http.Error.
+func (s *Server) renderError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	s.renderPage(w, status, "error", errorView{
+		pageView:   s.pageView(viewerStyle(w, r)),
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    msg,
+	})
+}
+
+func (s *Server) handleUploadPage(w http.ResponseWriter, r *http.Request) {
+	s.renderPage(w, 200, "upload", uploadView{
+		pageView:    s.pageView(viewerStyle(w, r)),
+		NoAuth:      s.Config.NoAuth,
+		MaxBodySize: s.Config.MaxBodySize,
+	})
+}
+
+const layoutTemplate = `{{ define "layout" }}
+<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="UTF-8">
+  <link rel="stylesheet" href="{{ .BaseURL }}style.css{{ if .Style }}?style={{ .Style }}{{ end }}">
+  <title>{{ block "title" . }}{{ .SiteName }}{{ end }}</title>
+{{ block "head" . }}{{ end -}}
+</head>
+<body>
+{{ template "content" . }}
+</body>
+</html>
+{{ end }}`
+
+const pasteTemplate = `{{ define "title" }}{{ with .Paste.Title }}{{ . }} - {{ end }}{{ .SiteName }}{{ end }}
+{{ define "head" }}
+{{- if .Paste.Description }}
+  <meta name="description" content="{{ .Paste.Description }}">
+{{- else }}
+  <meta name="description" content = "
+{{ range .Paste.Files -}}
+- {{ .Name }}
+{{ end -}}">
+{{- end }}
+{{ end }}
+{{ define "content" }}
+{{ with .Paste.Title }}<h1 class="title">{{ . }}</h1>{{ end }}
+{{ with .Paste.Description }}<p class="description">{{ . }}</p>{{ end }}
+{{ with .Paste.Tags }}
+<ul class="tags">
+{{ range . }}<li>{{ . }}</li>{{ end }}
+</ul>
+{{ end }}
+{{ if lt 1 (len .Paste.Files)}}
+<h1>files</h1>
+<div id="file-index">
+{{ template "tree" .Tree }}
+</div>
+<a href="{{ $.BaseURL }}{{ .Paste.ID }}/archive.zip">zip</a>
+<a href="{{ $.BaseURL }}{{ .Paste.ID }}/archive.tar.gz">tar.gz</a>
+{{ end }}
+{{ if .SiteURL }}
+<a href="{{ .SiteURL }}">site</a>
+{{ end }}
+{{ range .Paste.Files}}
+{{ if lt 1 (len $.Paste.Files)}}
+{{ end }}
+<h1 id="{{.Name}}" class="filename">{{.Name}}</h1>
+<a href="{{ $.BaseURL }}{{ rawPath . }}">raw</a>
+<a href="{{ $.BaseURL }}{{ rawPath . }}?download=1">download</a>
+{{ if .Size }}<span class="size">{{ size .Size }}</span>{{ end }}
+{{ if isMarkdown .Name }}
+{{ if $.Source }}
+<a href="?#{{ .Name }}">rendered</a>
+{{ else }}
+<a href="?source=1#{{ .Name }}">source</a>
+{{ end }}
+{{ end }}
+{{ renderFile $ . }}
+{{ end }}
+<script>
+{{ template "script" }}
+</script>
+{{ end }}
+{{ define "tree" }}
+<ul>
+{{ range .Dirs }}
+<li>
+<details open>
+<summary>{{ .Name }}/</summary>
+{{ template "tree" . }}
+</details>
+</li>
+{{ end }}
+{{ range .Files }}
+<li>
+<a href="#{{ .Name }}">{{ base .Name }}</a>
+</li>
+{{ end }}
+</ul>
+{{ end }}
+{{ define "script" }}
+// Clicking a line number links to that line, and shift-clicking another
+// one links to the lines in between, highlighted by the server.
+(function() {
+  var params = new URLSearchParams(location.search);
+  var multi = document.querySelectorAll(".filename").length > 1;
+  var lineID = /^(.*)-L(\d+)(?:-(\d+))?$/;
+  var anchor = null;
+
+  function link(name, start, end) {
+    if (start > end) {
+      var t = start; start = end; end = t;
+    }
+    var range = start == end ? "" + start : start + "-" + end;
+    params.delete("hl");
+    params.set("hl", (multi ? name + ":" : "") + range);
+    return "?" + params.toString() + "#" + encodeURIComponent(name) + "-L" + start;
+  }
+
+  // Links in the form #name-L10-20 are turned into highlighted ones.
+  var m = lineID.exec(decodeURIComponent(location.hash.slice(1)));
+  if (m && m[3] && !params.has("hl")) {
+    location.replace(link(m[1], +m[2], +m[3]));
+    return;
+  }
+
+  document.addEventListener("click", function(e) {
+    var t = e.target.closest(".lnt[id]");
+    if (!t) {
+      return;
+    }
+    var m = lineID.exec(t.id);
+    var line = +m[2];
+    if (e.shiftKey && anchor && anchor.name == m[1]) {
+      location.href = link(m[1], anchor.line, line);
+    } else {
+      anchor = {name: m[1], line: line};
+      location.href = link(m[1], line, line);
+    }
+  });
+  if (m) {
+    anchor = {name: m[1], line: +m[2]};
+  }
+})();
+{{ end }}`
+
+const uploadTemplate = `{{ define "title" }}upload - {{ .SiteName }}{{ end }}
+{{ define "content" }}
+<h1>upload</h1>
+<form id="upload" method="post" action="{{ .BaseURL }}" enctype="multipart/form-data">
+<p><input type="file" name="f" multiple required></p>
+<p><label>title <input type="text" name="title" maxlength="256"></label></p>
+<p><label>description<br><textarea name="description" rows="3" cols="60"></textarea></label></p>
+<p><label>tags <input type="text" name="tags" placeholder="comma separated"></label></p>
+<p><label>language <input type="text" name="l" placeholder="detect"></label></p>
+<p><label><input type="checkbox" name="x" value="1"> unpack archives</label></p>
+{{ if not .NoAuth }}
+<p><label>token <input type="password" name="token" required></label></p>
+{{ end }}
+<p><input type="submit" value="upload"></p>
+<p id="upload-status"></p>
+</form>
+<h2>screenshot tools</h2>
+<p>
+<a class="uploader" href="{{ .BaseURL }}api/v1/uploaders/sharex.sxcu">ShareX uploader</a>
+<a class="uploader" href="{{ .BaseURL }}api/v1/uploaders/flameshot.sh">Flameshot script</a>
+</p>
+<script>
+// The form is sent with fetch, so that files get their own indices and
+// the token can go in the Authorization header.
+document.getElementById("upload").addEventListener("submit", function(e) {
+  e.preventDefault();
+  var form = e.target;
+  var status = document.getElementById("upload-status");
+  var data = new FormData();
+  ["title", "description"].forEach(function(name) {
+    if (form.elements[name].value) {
+      data.append(name, form.elements[name].value);
+    }
+  });
+  form.elements.tags.value.split(",").forEach(function(tag) {
+    if (tag.trim()) {
+      data.append("tag", tag.trim());
+    }
+  });
+  var files = form.elements.f.files;
+  for (var i = 0; i < files.length; i++) {
+    var n = i + 1;
+    if (form.elements.l.value) {
+      data.append("l:" + n, form.elements.l.value);
+    }
+    if (form.elements.x.checked) {
+      data.append("x:" + n, "1");
+    }
+    data.append("f:" + n, files[i], files[i].name);
+  }
+  var headers = {};
+  if (form.elements.token) {
+    headers["Authorization"] = form.elements.token.value;
+  }
+  status.textContent = "uploading...";
+  fetch(form.action, {method: "POST", headers: headers, body: data})
+    .then(function(resp) {
+      return resp.text().then(function(text) {
+        if (!resp.ok) {
+          throw new Error(text);
+        }
+        location.href = text.trim();
+      });
+    })
+    .catch(function(err) {
+      status.textContent = err.message;
+    });
+});
+// The uploader configurations contain the token, which has to be sent
+// to get them, so they're downloaded with fetch too.
+document.querySelectorAll("a.uploader").forEach(function(a) {
+  a.addEventListener("click", function(e) {
+    e.preventDefault();
+    var form = document.getElementById("upload");
+    var status = document.getElementById("upload-status");
+    var headers = {};
+    if (form.elements.token) {
+      if (!form.elements.token.value) {
+        status.textContent = "enter your token first";
+        return;
+      }
+      headers["Authorization"] = form.elements.token.value;
+    }
+    fetch(a.href, {headers: headers})
+      .then(function(resp) {
+        if (!resp.ok) {
+          return resp.text().then(function(text) { throw new Error(text); });
+        }
+        return resp.blob();
+      })
+      .then(function(blob) {
+        var link = document.createElement("a");
+        link.href = URL.createObjectURL(blob);
+        link.download = a.href.split("/").pop();
+        link.click();
+        URL.revokeObjectURL(link.href);
+      })
+      .catch(function(err) {
+        status.textContent = err.message;
+      });
+  });
+});
+</script>
+{{ end }}`
+
+const errorTemplate = `{{ define "title" }}{{ .Status }} {{ .StatusText }} - {{ .SiteName }}{{ end }}
+{{ define "content" }}
+<h1>{{ .Status }} {{ .StatusText }}</h1>
+<p>{{ .Message }}</p>
+{{ end }}`
+
+const deleteTemplate = `{{ define "title" }}delete {{ .Paste.ID }} - {{ .SiteName }}{{ end }}
+{{ define "content" }}
+{{ if .Deleted }}
+<h1>deleted</h1>
+<p>The paste {{ .Paste.ID }} has been deleted.</p>
+{{ else }}
+<h1>delete {{ .Paste.ID }}?</h1>
+<p>This can't be undone. <a href="{{ .BaseURL }}{{ .Paste.ID }}">View the paste</a> first.</p>
+<form method="post">
+<p><input type="submit" value="delete"></p>
+</form>
+{{ end }}
+{{ end }}`
@@ -0,0 +1,173 @@
+package pimbin
+
+import (
+	"image"
+	"image/color"
+	_ "image/gif" // for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// maxThumbnailPixels is the largest image, in pixels, that a thumbnail
+// will be made from. Anything bigger is likely a decompression bomb.
+const maxThumbnailPixels = 50000000
+
+// thumbnailTypes are the content types that thumbnails can be made of.
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+func (s *Server) handleGetThumbnail(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !validHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	path, err := s.thumbnail(hash)
+	if err != nil {
+		// Let the browser have a go at it instead.
+		http.Redirect(w, r, s.Config.BaseURL+"raw/"+hash, http.StatusFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// Thumbnails are only ever made one way, so they're as immutable as
+	// the blobs they're made from. They need a tag of their own, though,
+	// since they're different content.
+	setImmutable(w, "thumb-"+hash)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// thumbnail returns the path to the thumbnail of the blob with the given
+// hash, generating it first if needed.
+func (s *Server) thumbnail(hash string) (string, error) {
+	dir := filepath.Join(s.Config.UploadsDir, "thumbs")
+	path := filepath.Join(dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	// Decoding images is expensive, so only do one at a time, and check
+	// that no one else made it while we were waiting.
+	s.thumbLock.Lock()
+	defer s.thumbLock.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	src, err := os.Open(filepath.Join(s.Config.UploadsDir, hash))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	cfg, format, err := image.DecodeConfig(src)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return "", image.ErrFormat
+	}
+	if _, err := src.Seek(0, 0); err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return "", err
+	}
+	img = scaleDown(img, s.Config.ThumbnailSize)
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, "thumb-*")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if format == "jpeg" {
+		err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(tmp, img)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return path, nil
+}
+
+// scaleDown shrinks img to fit in a size by size square, averaging the
+// source pixels covered by each pixel of the result.
+func scaleDown(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	dw, dh := size, size
+	if w > h {
+		dh = h * size / w
+	} else {
+		dw = w * size / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dh, bounds.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*w/dw, bounds.Min.X+(x+1)*w/dw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sr, sg, sb, sa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(sr), g+uint64(sg), b+uint64(sb), a+uint64(sa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// validHash reports whether hash looks like the name of a blob, which is
+// an unpadded URL-safe base64 encoded SHA-256 sum.
+func validHash(hash string) bool {
+	if len(hash) != 43 {
+		return false
+	}
+	return strings.Trim(hash, "ABCDEFGHIJKLMNOPQRSTUVWXYZ"+
+		"abcdefghijklmnopqrstuvwxyz0123456789-_") == ""
+}
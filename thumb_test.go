@@ -0,0 +1,86 @@
+package pimbin
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEtagMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"other", "abc"`, true},
+		{`"other"`, false},
+		{`abc`, false},
+		{"*", true},
+	}
+	for _, tt := range tests {
+		if got := etagMatch(tt.header, `"abc"`); got != tt.match {
+			t.Errorf("etagMatch(%q) = %t, want %t", tt.header, got, tt.match)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := s.downloadFile(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/thumb/"+hash, nil))
+	if w.Code != 200 {
+		t.Fatalf("got status %d", w.Code)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(256, 128) {
+		t.Errorf("got a %v thumbnail, want 256x128", size)
+	}
+	// The thumbnail isn't the blob, so they can't share an ETag.
+	etag := w.Header().Get("ETag")
+	if etag != `"thumb-`+hash+`"` {
+		t.Errorf("got ETag %s", etag)
+	}
+	req := httptest.NewRequest("GET", "/thumb/"+hash, nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != 304 {
+		t.Errorf("with a matching If-None-Match: got status %d, want 304", w.Code)
+	}
+	req = httptest.NewRequest("GET", "/thumb/"+hash, nil)
+	req.Header.Set("If-None-Match", `"`+hash+`"`)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("with the blob's ETag: got status %d, want 200", w.Code)
+	}
+
+	// Anything that isn't an image is left to the browser.
+	hash, err = s.downloadFile(strings.NewReader("not an image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/thumb/"+hash, nil))
+	if w.Code != 302 || w.Header().Get("Location") != s.Config.BaseURL+"raw/"+hash {
+		t.Errorf("thumbnail of text: got status %d and headers %v", w.Code, w.Header())
+	}
+}
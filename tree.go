@@ -0,0 +1,61 @@
+package pimbin
+
+import (
+	"path"
+	"strings"
+)
+
+// maxNameLen is the maximum length of a file's name, in bytes.
+const maxNameLen = 255
+
+// cleanName checks that name is a relative slash-separated path which
+// stays inside its root, and returns it in canonical form.
+func cleanName(name string) (string, bool) {
+	if name == "" || len(name) > maxNameLen ||
+		strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", false
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return "", false
+		}
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", false
+	}
+	return name, true
+}
+
+// fileTree is a directory in a paste's file index.
+type fileTree struct {
+	Name  string
+	Dirs  []*fileTree
+	Files []File
+}
+
+// buildTree arranges files into directories according to the
+// slash-separated paths in their names, keeping the order they came in.
+func buildTree(files []File) *fileTree {
+	root := &fileTree{}
+	for _, f := range files {
+		dir := root
+		segs := strings.Split(f.Name, "/")
+		for _, seg := range segs[:len(segs)-1] {
+			dir = dir.subdir(seg)
+		}
+		dir.Files = append(dir.Files, f)
+	}
+	return root
+}
+
+func (t *fileTree) subdir(name string) *fileTree {
+	for _, d := range t.Dirs {
+		if d.Name == name {
+			return d
+		}
+	}
+	d := &fileTree{Name: name}
+	t.Dirs = append(t.Dirs, d)
+	return d
+}
@@ -0,0 +1,51 @@
+package pimbin
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// treeString describes a tree on one line, with directories' contents in
+// brackets.
+func treeString(t *fileTree) string {
+	var parts []string
+	for _, d := range t.Dirs {
+		parts = append(parts, fmt.Sprintf("%s[%s]", d.Name, treeString(d)))
+	}
+	for _, f := range t.Files {
+		parts = append(parts, f.Name)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestBuildTree(t *testing.T) {
+	var files []File
+	for _, name := range []string{"README", "src/main.go", "src/util/a.go", "docs/x.md", "src/b.go"} {
+		files = append(files, File{Name: name})
+	}
+	want := "src[util[src/util/a.go] src/main.go src/b.go] docs[docs/x.md] README"
+	if got := treeString(buildTree(files)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestUploadFileNames(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	for _, name := range []string{"../evil", "/etc/passwd", `dir\file`, strings.Repeat("a", maxNameLen+1)} {
+		w := upload(s, formField{"file", name, "hello\n"})
+		if w.Code != 400 {
+			t.Errorf("uploading %q: got status %d, want 400", name, w.Code)
+		}
+	}
+	if left := blobs(t, s); len(left) != 0 {
+		t.Errorf("rejected uploads left blobs behind: %v", left)
+	}
+
+	w := upload(s, formField{"file", "dir/./a.txt", "hello\n"})
+	p := uploaded(t, s, w)
+	if len(p.Files) != 1 || p.Files[0].Name != "dir/a.txt" {
+		t.Errorf("got files %+v, want one named dir/a.txt", p.Files)
+	}
+}
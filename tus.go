@@ -0,0 +1,438 @@
+package pimbin
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/go-chi/chi"
+)
+
+// tusVersion is the version of the tus resumable upload protocol that's
+// implemented here, with the creation and termination extensions. See
+// https://tus.io/protocols/resumable-upload.html.
+const tusVersion = "1.0.0"
+
+// tusUpload is an upload in progress. It's kept as JSON next to the
+// partial data, which is in a file named after the upload's ID.
+type tusUpload struct {
+	Length int64  `json:"length"`
+	Owner  string `json:"owner"`
+	Name   string `json:"name"`
+	Lang   string `json:"lang"`
+	Strip  bool   `json:"strip"`
+	// Type is the content type that the client gave for the file.
+	Type string `json:"type"`
+
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	// Paste is the ID of the paste made once the upload is complete.
+	Paste string `json:"paste"`
+}
+
+func (s *Server) tusDir() string {
+	return filepath.Join(s.Config.UploadsDir, "tus")
+}
+
+// tusHeaders wraps the tus routes, checking the client's protocol version
+// and adding the headers that every response needs.
+func (s *Server) tusHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != "OPTIONS" && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.Config.TusMaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTusCreate starts a new upload. The file's name, type, language
+// and whether to keep its metadata can be given in Upload-Metadata as
+// filename, filetype, lang and keep-metadata, like the fields of a normal
+// upload, as well as the paste's title, description and comma separated
+// tags.
+func (s *Server) handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", 400)
+		return
+	}
+	if length > s.Config.TusMaxSize {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	upload := tusUpload{
+		Length: length,
+		Strip:  s.Config.StripMetadata,
+	}
+	if u, ok := r.Context().Value(userKey).(*User); ok {
+		upload.Owner = u.Name
+	}
+	meta, ok := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if !ok {
+		http.Error(w, "Invalid Upload-Metadata", 400)
+		return
+	}
+	if name := meta["filename"]; name != "" {
+		upload.Name, ok = cleanName(name)
+		if !ok {
+			http.Error(w, "Invalid file name", 400)
+			return
+		}
+	}
+	if lang := meta["lang"]; lang != "" {
+		lexer := lexers.Get(strings.TrimSpace(lang))
+		if lexer == nil {
+			http.Error(w, "Unknown language", 400)
+			return
+		}
+		upload.Lang = lexer.Config().Name
+	}
+	upload.Type = declaredType(meta["filetype"])
+	info := Paste{
+		Title:       meta["title"],
+		Description: meta["description"],
+		Tags:        splitTags(meta["tags"]),
+	}
+	if err := cleanInfo(&info); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	upload.Title, upload.Description, upload.Tags = info.Title, info.Description, info.Tags
+	if keep := meta["keep-metadata"]; keep != "" {
+		b, err := strconv.ParseBool(keep)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+		upload.Strip = s.Config.StripMetadata && !b
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	id := hex.EncodeToString(b[:])
+	if err := os.MkdirAll(s.tusDir(), 0750); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(s.tusDir(), id),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	f.Close()
+	if err := s.saveTusUpload(id, &upload); err != nil {
+		s.removeTusUpload(id)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Location", s.Config.BaseURL+"tus/"+id)
+	if length == 0 {
+		if status, msg := s.finishTusUpload(id, &upload); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		w.Header().Set("Paste-Location", s.Config.BaseURL+upload.Paste)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleTusHead(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "upload")
+	upload, offset, ok := s.loadTusUpload(w, r, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Paste != "" {
+		w.Header().Set("Paste-Location", s.Config.BaseURL+upload.Paste)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTusPatch appends to an upload. Once all of it has arrived, it's
+// stored like any other file and made into a paste, the URL of which is
+// sent back in Paste-Location.
+func (s *Server) handleTusPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	id := chi.URLParam(r, "upload")
+	if _, busy := s.tusLocks.LoadOrStore(id, struct{}{}); busy {
+		http.Error(w, "Upload is in use", http.StatusLocked)
+		return
+	}
+	defer s.tusLocks.Delete(id)
+	upload, offset, ok := s.loadTusUpload(w, r, id)
+	if !ok {
+		return
+	}
+	if upload.Paste != "" {
+		http.Error(w, "Upload is already complete", http.StatusConflict)
+		return
+	}
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		http.Error(w, "Upload-Offset doesn't match", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.tusDir(), id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// Whatever arrives is kept, even if the connection drops, so that the
+	// client can carry on from there.
+	n, err := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	f.Close()
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+		http.Error(w, "Upload is longer than Upload-Length", 400)
+		return
+	}
+	if status, msg := s.finishTusUpload(id, upload); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Paste-Location", s.Config.BaseURL+upload.Paste)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleTusDelete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "upload")
+	if _, busy := s.tusLocks.LoadOrStore(id, struct{}{}); busy {
+		http.Error(w, "Upload is in use", http.StatusLocked)
+		return
+	}
+	defer s.tusLocks.Delete(id)
+	if _, _, ok := s.loadTusUpload(w, r, id); !ok {
+		return
+	}
+	s.removeTusUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadTusUpload loads an upload and the length of its partial data, checking
+// that it belongs to the user making the request. If it can't, it writes
+// an error to w and returns false.
+func (s *Server) loadTusUpload(w http.ResponseWriter, r *http.Request, id string) (*tusUpload, int64, bool) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		http.NotFound(w, r)
+		return nil, 0, false
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.tusDir(), id+".json"))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return nil, 0, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil, 0, false
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(b, &upload); err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil, 0, false
+	}
+	var username string
+	if u, ok := r.Context().Value(userKey).(*User); ok {
+		username = u.Name
+	}
+	if upload.Owner != username {
+		http.Error(w, "unauthorized", 401)
+		return nil, 0, false
+	}
+	info, err := os.Stat(filepath.Join(s.tusDir(), id))
+	if err != nil && upload.Paste == "" {
+		http.Error(w, err.Error(), 500)
+		return nil, 0, false
+	}
+	offset := upload.Length
+	if upload.Paste == "" {
+		offset = info.Size()
+	}
+	return &upload, offset, true
+}
+
+func (s *Server) saveTusUpload(id string, upload *tusUpload) error {
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.tusDir(), id+".json"), b, 0640)
+}
+
+func (s *Server) removeTusUpload(id string) {
+	os.Remove(filepath.Join(s.tusDir(), id))
+	os.Remove(filepath.Join(s.tusDir(), id+".json"))
+}
+
+// finishTusUpload turns a complete upload into a paste. The upload's
+// description is kept until it expires, so that a client which didn't get
+// the response can still find the paste with a HEAD request. It returns a
+// status and message for the response if that fails.
+func (s *Server) finishTusUpload(id string, upload *tusUpload) (int, string) {
+	path := filepath.Join(s.tusDir(), id)
+	f, err := os.Open(path)
+	if err != nil {
+		return 500, err.Error()
+	}
+	hash, ctype, err := s.storeFile(f, upload.Strip)
+	f.Close()
+	switch err {
+	case nil:
+	case errTypeNotAllowed:
+		s.removeTusUpload(id)
+		return 418, "Content type not allowed"
+	case errBadImage:
+		s.removeTusUpload(id)
+		return 400, err.Error()
+	default:
+		return 500, err.Error()
+	}
+	var kept []File
+	defer func() { s.releaseBlobs([]string{hash}, kept) }()
+	name := upload.Name
+	if name == "" {
+		if exts, err := mime.ExtensionsByType(ctype); err == nil {
+			name = exts[0]
+		}
+	}
+	paste := Paste{
+		ID:    s.id(),
+		Owner: upload.Owner,
+		Files: []File{{
+			Hash:         hash,
+			Name:         name,
+			Lang:         upload.Lang,
+			DeclaredType: upload.Type,
+		}},
+
+		Title:       upload.Title,
+		Description: upload.Description,
+		Tags:        upload.Tags,
+	}
+	if err := s.describePaste(&paste); err != nil {
+		return 500, err.Error()
+	}
+	if err := s.db.PutPaste(paste); err != nil {
+		return 500, err.Error()
+	}
+	kept = paste.Files
+	s.indexPaste(paste)
+	upload.Paste = paste.ID
+	if err := s.saveTusUpload(id, upload); err != nil {
+		log.Println("tus:", err)
+	}
+	os.Remove(path)
+	return 0, ""
+}
+
+// parseTusMetadata parses an Upload-Metadata header, which is a comma
+// separated list of keys, each followed by a space and a base64 encoded
+// value if it has one.
+func parseTusMetadata(header string) (map[string]string, bool) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, true
+	}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		switch len(kv) {
+		case 1:
+			meta[kv[0]] = ""
+		case 2:
+			v, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, false
+			}
+			meta[kv[0]] = string(v)
+		default:
+			return nil, false
+		}
+	}
+	return meta, true
+}
+
+// cleanTusUploads removes expired uploads every hour, until the server
+// is closed.
+func (s *Server) cleanTusUploads() {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		s.removeExpiredTusUploads()
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// removeExpiredTusUploads removes uploads that haven't been touched for
+// longer than the configured expiry.
+func (s *Server) removeExpiredTusUploads() {
+	expiry := time.Duration(s.Config.TusExpiry) * time.Hour
+	infos, _ := ioutil.ReadDir(s.tusDir())
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") ||
+			time.Since(info.ModTime()) < expiry {
+			continue
+		}
+		// The data is written to much more often than the description,
+		// so it's what goes for the whole upload.
+		id := info.Name()
+		if _, busy := s.tusLocks.Load(id); !busy {
+			s.removeTusUpload(id)
+		}
+	}
+	// Descriptions of finished uploads have nothing beside them.
+	for _, info := range infos {
+		id := strings.TrimSuffix(info.Name(), ".json")
+		if id == info.Name() || time.Since(info.ModTime()) < expiry {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.tusDir(), id)); os.IsNotExist(err) {
+			os.Remove(filepath.Join(s.tusDir(), info.Name()))
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package pimbin
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erebid/pimbin/config"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	tests := []struct {
+		in   string
+		want map[string]string
+		ok   bool
+	}{
+		{"", map[string]string{}, true},
+		{" ", map[string]string{}, true},
+		{"filename " + b64([]byte("a b.txt")), map[string]string{"filename": "a b.txt"}, true},
+		{"keep-metadata,title " + b64([]byte("Title")),
+			map[string]string{"keep-metadata": "", "title": "Title"}, true},
+		{"a " + b64([]byte("1")) + " , b " + b64([]byte("2")),
+			map[string]string{"a": "1", "b": "2"}, true},
+		{"filename not*base64", nil, false},
+		{"a b c", nil, false},
+		{"a,,b", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTusMetadata(tt.in)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTusMetadata(%q) = %v, %t, want %v, %t", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// tusMetadata encodes pairs of keys and values as Upload-Metadata.
+func tusMetadata(kv ...string) string {
+	var pairs []string
+	for i := 0; i < len(kv); i += 2 {
+		pairs = append(pairs, kv[i]+" "+base64.StdEncoding.EncodeToString([]byte(kv[i+1])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// tusRequest makes a tus request to the server, at a path or a URL it
+// gave. headers are pairs of names and values, added to Tus-Resumable.
+func tusRequest(s *Server, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	if strings.HasPrefix(path, s.Config.BaseURL) {
+		path = "/" + strings.TrimPrefix(path, s.Config.BaseURL)
+	}
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestTus(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+
+	req := httptest.NewRequest("OPTIONS", "/tus/", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != 204 || w.Header().Get("Tus-Version") != tusVersion ||
+		w.Header().Get("Tus-Max-Size") != "512000000" {
+		t.Errorf("OPTIONS: got status %d and headers %v", w.Code, w.Header())
+	}
+	req = httptest.NewRequest("POST", "/tus/", nil)
+	req.Header.Set("Upload-Length", "11")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != 412 {
+		t.Errorf("creating without Tus-Resumable: got status %d, want 412", w.Code)
+	}
+
+	w = tusRequest(s, "POST", "/tus/", "", "Upload-Length", "11", "Upload-Metadata",
+		tusMetadata("filename", "dir/a b.txt", "title", "Title", "tags", "x,Y"))
+	if w.Code != 201 || w.Header().Get("Tus-Resumable") != tusVersion {
+		t.Fatalf("creating: got status %d and headers %v", w.Code, w.Header())
+	}
+	loc := w.Header().Get("Location")
+	if !strings.HasPrefix(loc, s.Config.BaseURL+"tus/") {
+		t.Fatalf("got Location %q", loc)
+	}
+	offset := func(want string) {
+		t.Helper()
+		w := tusRequest(s, "HEAD", loc, "")
+		if w.Code != 200 || w.Header().Get("Upload-Offset") != want ||
+			w.Header().Get("Upload-Length") != "11" || w.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("HEAD: got status %d and headers %v, want offset %s", w.Code, w.Header(), want)
+		}
+	}
+	offset("0")
+
+	const octets = "application/offset+octet-stream"
+	if w := tusRequest(s, "PATCH", loc, "hello", "Upload-Offset", "0"); w.Code != 415 {
+		t.Errorf("PATCH without a Content-Type: got status %d, want 415", w.Code)
+	}
+	if w := tusRequest(s, "PATCH", loc, "hello", "Content-Type", octets, "Upload-Offset", "5"); w.Code != 409 {
+		t.Errorf("PATCH at the wrong offset: got status %d, want 409", w.Code)
+	}
+	w = tusRequest(s, "PATCH", loc, "hello", "Content-Type", octets, "Upload-Offset", "0")
+	if w.Code != 204 || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Paste-Location") != "" {
+		t.Errorf("first PATCH: got status %d and headers %v", w.Code, w.Header())
+	}
+	offset("5")
+	w = tusRequest(s, "PATCH", loc, " world", "Content-Type", octets, "Upload-Offset", "5")
+	if w.Code != 204 || w.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("last PATCH: got status %d and headers %v: %s", w.Code, w.Header(), w.Body)
+	}
+	pasteLoc := w.Header().Get("Paste-Location")
+	p, err := s.db.Paste(strings.TrimPrefix(pasteLoc, s.Config.BaseURL))
+	if err != nil {
+		t.Fatalf("getting the paste at %q: %v", pasteLoc, err)
+	}
+	if p.Title != "Title" || !reflect.DeepEqual(p.Tags, []string{"x", "y"}) ||
+		len(p.Files) != 1 || p.Files[0].Name != "dir/a b.txt" || p.Files[0].Size != 11 {
+		t.Errorf("got paste %+v", p)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.Config.UploadsDir, p.Files[0].Hash))
+	if err != nil || string(b) != "hello world" {
+		t.Errorf("the paste's file contains %q, error %v", b, err)
+	}
+
+	// The finished upload still points to its paste.
+	offset("11")
+	if got := tusRequest(s, "HEAD", loc, "").Header().Get("Paste-Location"); got != pasteLoc {
+		t.Errorf("HEAD after finishing: got Paste-Location %q, want %q", got, pasteLoc)
+	}
+	if w := tusRequest(s, "PATCH", loc, "more", "Content-Type", octets, "Upload-Offset", "11"); w.Code != 409 {
+		t.Errorf("PATCH after finishing: got status %d, want 409", w.Code)
+	}
+	if w := tusRequest(s, "DELETE", loc, ""); w.Code != 204 {
+		t.Errorf("DELETE: got status %d, want 204", w.Code)
+	}
+	if w := tusRequest(s, "HEAD", loc, ""); w.Code != 404 {
+		t.Errorf("HEAD after DELETE: got status %d, want 404", w.Code)
+	}
+	if w := tusRequest(s, "HEAD", "/tus/nothex", ""); w.Code != 404 {
+		t.Errorf("HEAD with an invalid ID: got status %d, want 404", w.Code)
+	}
+}
+
+func TestTusEmpty(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	w := tusRequest(s, "POST", "/tus/", "", "Upload-Length", "0")
+	if w.Code != 201 || w.Header().Get("Paste-Location") == "" {
+		t.Errorf("creating an empty upload: got status %d and headers %v", w.Code, w.Header())
+	}
+}
+
+func TestTusTooLong(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	loc := tusRequest(s, "POST", "/tus/", "", "Upload-Length", "3").Header().Get("Location")
+	w := tusRequest(s, "PATCH", loc, "hello", "Content-Type", "application/offset+octet-stream",
+		"Upload-Offset", "0")
+	if w.Code != 400 {
+		t.Errorf("PATCH past Upload-Length: got status %d, want 400", w.Code)
+	}
+
+	if w := tusRequest(s, "DELETE", loc, ""); w.Code != 204 {
+		t.Errorf("DELETE: got status %d, want 204", w.Code)
+	}
+	if infos, _ := ioutil.ReadDir(s.tusDir()); len(infos) != 0 {
+		t.Errorf("DELETE left %d files behind", len(infos))
+	}
+}
+
+func TestTusCreateErrors(t *testing.T) {
+	s, cleanup := newTestServer(t, func(cfg *config.Server) { cfg.TusMaxSize = 100 })
+	defer cleanup()
+	tests := []struct {
+		name     string
+		length   string
+		metadata string
+		status   int
+	}{
+		{"no length", "", "", 400},
+		{"negative length", "-1", "", 400},
+		{"too large", "101", "", 413},
+		{"bad metadata", "1", "filename ???", 400},
+		{"bad file name", "1", tusMetadata("filename", "../a"), 400},
+		{"unknown language", "1", tusMetadata("lang", "no such language"), 400},
+		{"bad keep-metadata", "1", tusMetadata("keep-metadata", "maybe"), 400},
+		{"bad tag", "1", tusMetadata("tags", "a b"), 400},
+		{"long title", "1", tusMetadata("title", strings.Repeat("a", maxTitleLen+1)), 400},
+	}
+	for _, tt := range tests {
+		w := tusRequest(s, "POST", "/tus/", "", "Upload-Length", tt.length, "Upload-Metadata", tt.metadata)
+		if w.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+	if _, err := os.Stat(s.tusDir()); !os.IsNotExist(err) {
+		t.Error("a rejected upload was started")
+	}
+}
+
+func TestTusOwner(t *testing.T) {
+	s, cleanup := newTestServer(t, func(cfg *config.Server) { cfg.NoAuth = false })
+	defer cleanup()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+
+	if w := tusRequest(s, "POST", "/tus/", "", "Upload-Length", "5"); w.Code != 401 {
+		t.Errorf("creating without a token: got status %d, want 401", w.Code)
+	}
+	w := tusRequest(s, "POST", "/tus/", "", "Upload-Length", "5", "Authorization", alice)
+	if w.Code != 201 {
+		t.Fatalf("creating: got status %d, want 201", w.Code)
+	}
+	loc := w.Header().Get("Location")
+	if w := tusRequest(s, "HEAD", loc, "", "Authorization", bob); w.Code != 401 {
+		t.Errorf("HEAD by another user: got status %d, want 401", w.Code)
+	}
+	if w := tusRequest(s, "DELETE", loc, "", "Authorization", bob); w.Code != 401 {
+		t.Errorf("DELETE by another user: got status %d, want 401", w.Code)
+	}
+	w = tusRequest(s, "PATCH", loc, "hello", "Authorization", alice,
+		"Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+	if w.Code != 204 {
+		t.Fatalf("PATCH: got status %d, want 204", w.Code)
+	}
+	p, err := s.db.Paste(strings.TrimPrefix(w.Header().Get("Paste-Location"), s.Config.BaseURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Owner != "alice" {
+		t.Errorf("the paste belongs to %q, want alice", p.Owner)
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	create := func() string {
+		w := tusRequest(s, "POST", "/tus/", "", "Upload-Length", "5")
+		if w.Code != 201 {
+			t.Fatalf("creating: got status %d", w.Code)
+		}
+		return path.Base(w.Header().Get("Location"))
+	}
+	expired, busy, fresh := create(), create(), create()
+	finished := path.Base(tusRequest(s, "POST", "/tus/", "", "Upload-Length", "0").Header().Get("Location"))
+	old := time.Now().Add(-time.Duration(s.Config.TusExpiry+1) * time.Hour)
+	for _, name := range []string{expired, expired + ".json", busy, busy + ".json", finished + ".json"} {
+		if err := os.Chtimes(filepath.Join(s.tusDir(), name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A request is still writing to this one.
+	s.tusLocks.Store(busy, struct{}{})
+
+	s.removeExpiredTusUploads()
+	var left []string
+	infos, err := ioutil.ReadDir(s.tusDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		left = append(left, info.Name())
+	}
+	want := []string{busy, busy + ".json", fresh, fresh + ".json"}
+	sort.Strings(want)
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("got %q left, want %q", left, want)
+	}
+
+	// Once the server is closed, cleaning up stops after one more go.
+	cleanup()
+	done := make(chan struct{})
+	go func() {
+		s.cleanTusUploads()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("cleaning up carried on after the server was closed")
+	}
+}
@@ -0,0 +1,143 @@
+package pimbin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// writeUploadResponse tells the client where its new paste is. That's
+// the paste's URL on a line of its own, or for clients that accept JSON,
+// like screenshot tools, an object with the URL and a URL that deletes
+// the paste without needing a token.
+func (s *Server) writeUploadResponse(w http.ResponseWriter, r *http.Request, p Paste) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		fmt.Fprintf(w, "%s%s\n", s.Config.BaseURL, p.ID)
+		return
+	}
+	resp := struct {
+		URL       string `json:"url"`
+		DeleteURL string `json:"delete_url,omitempty"`
+	}{URL: s.Config.BaseURL + p.ID}
+	if key := s.deleteKey(&p); key != "" {
+		resp.DeleteURL = s.Config.BaseURL + p.ID + "/delete/" + key
+	}
+	writeJSON(w, resp)
+}
+
+// deleteKey returns the key that allows deleting p without a token. It's
+// derived from the owner's token, so refreshing the token revokes every
+// key. Pastes without an owner can't have one.
+func (s *Server) deleteKey(p *Paste) string {
+	u, ok := s.users[p.Owner]
+	if !ok || u.Token == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(u.Token))
+	mac.Write([]byte("delete:" + p.ID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+// handleDeleteWithKey deletes a paste given its deletion key. A GET asks
+// for confirmation first, so that link previews and prefetching don't
+// delete anything.
+func (s *Server) handleDeleteWithKey(w http.ResponseWriter, r *http.Request) {
+	p, err := s.db.Paste(chi.URLParam(r, "id"))
+	if err != nil {
+		s.renderError(w, r, http.StatusNotFound, "There's no paste with that ID.")
+		return
+	}
+	key := s.deleteKey(p)
+	if key == "" || !hmac.Equal([]byte(key), []byte(chi.URLParam(r, "key"))) {
+		s.renderError(w, r, http.StatusForbidden, "That deletion link isn't valid.")
+		return
+	}
+	view := deleteView{pageView: s.pageView(viewerStyle(w, r)), Paste: *p}
+	if r.Method == "POST" {
+		if err := s.db.DeletePaste(p.ID); err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		view.Deleted = true
+	}
+	s.renderPage(w, 200, "delete", view)
+}
+
+// shareXUploader is a ShareX custom uploader, as in an .sxcu file.
+type shareXUploader struct {
+	Version         string
+	Name            string
+	DestinationType string
+	RequestMethod   string
+	RequestURL      string
+	Headers         map[string]string `json:",omitempty"`
+	Body            string
+	FileFormName    string
+	URL             string
+	DeletionURL     string
+	ErrorMessage    string
+}
+
+// uploadToken returns the token of the user making the request, for
+// putting in uploader configurations.
+func uploadToken(r *http.Request) string {
+	if u, ok := r.Context().Value(userKey).(*User); ok {
+		return u.Token
+	}
+	return ""
+}
+
+func (s *Server) handleShareX(w http.ResponseWriter, r *http.Request) {
+	uploader := shareXUploader{
+		Version:         "13.7.0",
+		Name:            s.Config.SiteName,
+		DestinationType: "ImageUploader, TextUploader, FileUploader",
+		RequestMethod:   "POST",
+		RequestURL:      s.Config.BaseURL,
+		Headers:         map[string]string{"Accept": "application/json"},
+		Body:            "MultipartFormData",
+		FileFormName:    "file",
+		URL:             "{json:url}",
+		DeletionURL:     "{json:delete_url}",
+		ErrorMessage:    "{response}",
+	}
+	if token := uploadToken(r); token != "" {
+		uploader.Headers["Authorization"] = token
+	}
+	w.Header().Set("Content-Disposition",
+		contentDisposition("attachment", s.Config.SiteName+".sxcu"))
+	writeJSON(w, uploader)
+}
+
+// handleFlameshot sends a shell script that takes a screenshot with
+// Flameshot, uploads it and copies its URL, since Flameshot has no
+// custom uploaders of its own. Other tools that can write a screenshot
+// to stdout can be swapped in.
+func (s *Server) handleFlameshot(w http.ResponseWriter, r *http.Request) {
+	var auth string
+	if token := uploadToken(r); token != "" {
+		auth = "-H " + shellQuote("Authorization: "+token) + " "
+	}
+	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		contentDisposition("attachment", s.Config.SiteName+"-flameshot.sh"))
+	fmt.Fprintf(w, `#!/bin/sh
+# Takes a screenshot with Flameshot, uploads it to %s and copies the URL
+# of the paste to the clipboard.
+set -e
+url=$(flameshot gui --raw | curl -fsS %s-F 'file=@-;filename=screenshot.png' %s)
+printf '%%s' "$url" | xclip -selection clipboard 2>/dev/null ||
+	printf '%%s' "$url" | wl-copy
+echo "$url"
+`, s.Config.SiteName, auth, shellQuote(s.Config.BaseURL))
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}